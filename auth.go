@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ROLE_ADMIN = "admin"
+const ROLE_ISSUER = "issuer"
+const ROLE_CONSUMER = "consumer"
+
+// Operators run the service, they manage the master keys shared by all tenants
+const ROLE_OPERATOR = "operator"
+
+const API_KEY_HEADER = "X-API-Key"
+const PRINCIPAL_KEY = "principal"
+
+// Keys shorter than this are rejected by the config validation.
+const MIN_API_KEY_LENGTH = 16
+
+var ErrUnauthenticated = NewAPIError(http.StatusUnauthorized, "unauthenticated", "Missing or invalid API key")
+var ErrForbidden = NewAPIError(http.StatusForbidden, "forbidden", "The API key is not allowed to use this endpoint")
+
+// Credential is an API key the service accepts, the role it grants and the
+// tenant it acts for. Name identifies the caller in logs and records.
+type Credential struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func validRole(role string) bool {
+	return role == ROLE_ADMIN || role == ROLE_ISSUER || role == ROLE_CONSUMER || role == ROLE_OPERATOR
+}
+
+// requestAPIKey returns the key sent as a bearer token or in the X-API-Key header.
+func requestAPIKey(c *gin.Context) string {
+
+	if token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return c.GetHeader(API_KEY_HEADER)
+}
+
+// Authenticate resolves the API key of the request to one of the credentials
+// and stores it as the principal. Requests without a known key are rejected.
+func Authenticate(credentials []Credential) gin.HandlerFunc {
+
+	// Keys are looked up by their hash, so the lookup time doesn't depend on
+	// how much of a guessed key matches
+	byHash := make(map[[sha256.Size]byte]Credential, len(credentials))
+	for _, credential := range credentials {
+		byHash[sha256.Sum256([]byte(credential.Key))] = credential
+	}
+
+	return func(c *gin.Context) {
+		key := requestAPIKey(c)
+		if key == "" {
+			abortWithError(c, ErrUnauthenticated)
+			return
+		}
+
+		credential, found := byHash[sha256.Sum256([]byte(key))]
+		if !found {
+			abortWithError(c, ErrUnauthenticated)
+			return
+		}
+
+		c.Set(PRINCIPAL_KEY, credential)
+		c.Next()
+	}
+}
+
+// RequireRole only lets principals with one of the roles through. It must run
+// after Authenticate.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, found := Principal(c)
+		if !found {
+			abortWithError(c, ErrUnauthenticated)
+			return
+		}
+		if !slices.Contains(roles, principal.Role) {
+			abortWithError(c, ErrForbidden.WithDetails(gin.H{"role": principal.Role}))
+			return
+		}
+		c.Next()
+	}
+}
+
+// Principal returns the credential the request was authenticated with.
+func Principal(c *gin.Context) (Credential, bool) {
+	value, found := c.Get(PRINCIPAL_KEY)
+	if !found {
+		return Credential{}, false
+	}
+	credential, ok := value.(Credential)
+	return credential, ok
+}
+
+// requestedBy names the caller for records, the client address if the route
+// isn't authenticated.
+func requestedBy(c *gin.Context) string {
+	if principal, found := Principal(c); found {
+		return principal.Name
+	}
+	return c.ClientIP()
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+const DB_FILE = "sles.db"
+
+var metaBucket = []byte("meta")
+var licensesBucket = []byte("licenses")
+var filesBucket = []byte("files")
+var linksBucket = []byte("links")
+var ratesBucket = []byte("rates")
+var usageBucket = []byte("usage")
+var rotationsBucket = []byte("rotations")
+var schemaVersionKey = []byte("schemaVersion")
+
+// migrations[i] upgrades the schema from version i to i+1 and runs inside the
+// same transaction that records the new version. Only ever append to this
+// list, released migrations must not change.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: licenses and files buckets
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{licensesBucket, filesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: secure link registry
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(linksBucket)
+		return err
+	},
+	// 3: tenants. Existing data moves to the default tenant, files stay where
+	// they are in the storage directory and are keyed by tenant and name.
+	func(tx *bolt.Tx) error {
+		// The records as they were stored at this version
+		type License struct {
+			Key        uuid.UUID `json:"key"`
+			Type       string    `json:"type"`
+			ExpiryDate time.Time `json:"expiryDate"`
+			TokensLeft int       `json:"tokensLeft"`
+			Tenant     string    `json:"tenant"`
+		}
+		type FileRecord struct {
+			Name         string    `json:"name"`
+			Tenant       string    `json:"tenant"`
+			Path         string    `json:"path"`
+			LicenseKey   uuid.UUID `json:"licenseKey"`
+			OriginalName string    `json:"originalName,omitempty"`
+			ContentType  string    `json:"contentType,omitempty"`
+			CreatedAt    time.Time `json:"createdAt"`
+		}
+		type LinkRecord struct {
+			ID           string     `json:"id"`
+			FilePath     string     `json:"filepath"`
+			LicenseKey   uuid.UUID  `json:"licenseKey"`
+			Tenant       string     `json:"tenant"`
+			CreatedBy    string     `json:"createdBy"`
+			CreatedAt    time.Time  `json:"createdAt"`
+			ExpiresAt    time.Time  `json:"expiresAt"`
+			MaxDownloads int        `json:"maxDownloads,omitempty"`
+			Downloads    int        `json:"downloads"`
+			RevokedAt    *time.Time `json:"revokedAt,omitempty"`
+		}
+
+		if err := rewriteBucket(tx.Bucket(licensesBucket), func(key []byte, raw []byte) ([]byte, []byte, error) {
+			var license License
+			if err := json.Unmarshal(raw, &license); err != nil {
+				return nil, nil, err
+			}
+			license.Tenant = DEFAULT_TENANT
+			raw, err := json.Marshal(license)
+			return key, raw, err
+		}); err != nil {
+			return err
+		}
+
+		if err := rewriteBucket(tx.Bucket(filesBucket), func(_ []byte, raw []byte) ([]byte, []byte, error) {
+			var record FileRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return nil, nil, err
+			}
+			record.Tenant = DEFAULT_TENANT
+			record.Path = record.Name
+			raw, err := json.Marshal(record)
+			return []byte(fileKey(record.Tenant, record.Name)), raw, err
+		}); err != nil {
+			return err
+		}
+
+		return rewriteBucket(tx.Bucket(linksBucket), func(key []byte, raw []byte) ([]byte, []byte, error) {
+			var link LinkRecord
+			if err := json.Unmarshal(raw, &link); err != nil {
+				return nil, nil, err
+			}
+			link.Tenant = DEFAULT_TENANT
+			raw, err := json.Marshal(link)
+			return key, raw, err
+		})
+	},
+	// 4: file ids. Existing files keep their name as id, so links and clients
+	// that know the name keep working.
+	func(tx *bolt.Tx) error {
+		if err := rewriteBucket(tx.Bucket(filesBucket), func(_ []byte, raw []byte) ([]byte, []byte, error) {
+			var tenant, name string
+			raw, err := patchJSON(raw, func(fields map[string]any) {
+				tenant, _ = fields["tenant"].(string)
+				name, _ = fields["name"].(string)
+				fields["id"] = name
+				if original, _ := fields["originalName"].(string); original == "" {
+					fields["originalName"] = strings.TrimSuffix(name, filepath.Ext(name))
+				}
+				delete(fields, "name")
+			})
+			return []byte(fileKey(tenant, name)), raw, err
+		}); err != nil {
+			return err
+		}
+
+		return rewriteBucket(tx.Bucket(linksBucket), func(key []byte, raw []byte) ([]byte, []byte, error) {
+			raw, err := patchJSON(raw, func(fields map[string]any) {
+				fields["fileId"] = fields["filepath"]
+				delete(fields, "filepath")
+			})
+			return key, raw, err
+		})
+	},
+	// 5: license status. Existing licenses are active.
+	func(tx *bolt.Tx) error {
+		return rewriteBucket(tx.Bucket(licensesBucket), func(key []byte, raw []byte) ([]byte, []byte, error) {
+			raw, err := patchJSON(raw, func(fields map[string]any) {
+				fields["status"] = LICENSE_ACTIVE
+			})
+			return key, raw, err
+		})
+	},
+	// 6: optional token budgets. Time-bound licenses stored an unused zero
+	// token count, which would now read as an exhausted budget.
+	func(tx *bolt.Tx) error {
+		return rewriteBucket(tx.Bucket(licensesBucket), func(key []byte, raw []byte) ([]byte, []byte, error) {
+			raw, err := patchJSON(raw, func(fields map[string]any) {
+				if fields["type"] != USAGE_LIMITED {
+					delete(fields, "tokensLeft")
+				}
+			})
+			return key, raw, err
+		})
+	},
+	// 7: rate limit counters, keyed by license
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ratesBucket)
+		return err
+	},
+	// 8: usage records, keyed by license and sequence number
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	},
+	// 9: key rotation jobs, keyed by id. Files without a key version are left
+	// as they are, their version is only known once they are rotated.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(rotationsBucket)
+		return err
+	},
+	// 10: key manager of files. Existing files were wrapped by the local
+	// keyring, the only key manager before.
+	func(tx *bolt.Tx) error {
+		return rewriteBucket(tx.Bucket(filesBucket), func(key []byte, raw []byte) ([]byte, []byte, error) {
+			raw, err := patchJSON(raw, func(fields map[string]any) {
+				if fields["keyManager"] == nil {
+					fields["keyManager"] = KEY_MANAGER_LOCAL
+				}
+			})
+			return key, raw, err
+		})
+	},
+}
+
+// patchJSON applies change to the fields of a stored JSON object. Migrations
+// work on the raw fields, so they don't depend on the current record types.
+func patchJSON(raw []byte, change func(fields map[string]any)) ([]byte, error) {
+
+	fields := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// Keeps large numbers like token counts exact
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	change(fields)
+	return json.Marshal(fields)
+}
+
+// rewriteBucket replaces every entry of the bucket with the key and value
+// returned by change. Used by migrations, bolt doesn't allow writes while
+// iterating.
+func rewriteBucket(bucket *bolt.Bucket, change func(key []byte, raw []byte) ([]byte, []byte, error)) error {
+
+	var keys, values [][]byte
+	err := bucket.ForEach(func(key []byte, raw []byte) error {
+		newKey, newRaw, err := change(key, raw)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte{}, key...))
+		values = append(values, newKey, newRaw)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(values); i += 2 {
+		if err := bucket.Put(values[i], values[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BoltStore persists licenses and files in an embedded BoltDB database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// SchemaVersion returns the schema version of the database.
+func (s *BoltStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx.Bucket(metaBucket))
+		return nil
+	})
+	return version, err
+}
+
+func schemaVersion(meta *bolt.Bucket) int {
+	if meta == nil {
+		return 0
+	}
+	raw := meta.Get(schemaVersionKey)
+	if len(raw) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(raw))
+}
+
+// migrate brings the database up to the latest schema version.
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		version := schemaVersion(meta)
+		if version > len(migrations) {
+			return fmt.Errorf("Database schema version %d is newer than the supported version %d", version, len(migrations))
+		}
+
+		for ; version < len(migrations); version++ {
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("Migration to schema version %d failed: %w", version+1, err)
+			}
+		}
+
+		return meta.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, uint64(version)))
+	})
+}
+
+func (s *BoltStore) GetLicense(key uuid.UUID) (License, error) {
+	var license License
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(licensesBucket).Get(key[:])
+		if raw == nil {
+			return ErrLicenseNotFound
+		}
+		return json.Unmarshal(raw, &license)
+	})
+	return license, err
+}
+
+func (s *BoltStore) PutLicense(license License) error {
+	raw, err := json.Marshal(license)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(licensesBucket).Put(license.Key[:], raw)
+	})
+}
+
+func (s *BoltStore) ConsumeLicense(key uuid.UUID, operation string, now time.Time) (License, error) {
+	var license License
+
+	// Bolt runs one write transaction at a time, which serializes consumers
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(licensesBucket)
+
+		raw := bucket.Get(key[:])
+		if raw == nil {
+			return ErrLicenseNotFound
+		}
+		if err := json.Unmarshal(raw, &license); err != nil {
+			return err
+		}
+		if err := CheckLicense(license, operation, now); err != nil {
+			return err
+		}
+
+		if license.TokensLeft == nil && license.EncryptTokensLeft == nil && license.DecryptTokensLeft == nil {
+			return nil
+		}
+		SpendLicense(&license, operation)
+		raw, err := json.Marshal(license)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key[:], raw)
+	})
+	return license, err
+}
+
+func (s *BoltStore) UpdateLicense(key uuid.UUID, change func(license *License) error) (License, error) {
+	var license License
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(licensesBucket)
+
+		raw := bucket.Get(key[:])
+		if raw == nil {
+			return ErrLicenseNotFound
+		}
+		if err := json.Unmarshal(raw, &license); err != nil {
+			return err
+		}
+		if err := change(&license); err != nil {
+			return err
+		}
+
+		raw, err := json.Marshal(license)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key[:], raw)
+	})
+	return license, err
+}
+
+func (s *BoltStore) DeleteLicense(key uuid.UUID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(licensesBucket)
+		if bucket.Get(key[:]) == nil {
+			return ErrLicenseNotFound
+		}
+		if err := tx.Bucket(ratesBucket).Delete(key[:]); err != nil {
+			return err
+		}
+		return bucket.Delete(key[:])
+	})
+}
+
+func (s *BoltStore) ListLicenses(tenant string) ([]License, error) {
+	licenses := []License{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(licensesBucket).ForEach(func(_, raw []byte) error {
+			var license License
+			if err := json.Unmarshal(raw, &license); err != nil {
+				return err
+			}
+			if license.Tenant == tenant {
+				licenses = append(licenses, license)
+			}
+			return nil
+		})
+	})
+	// Same order as the memory store
+	sort.Slice(licenses, func(i, j int) bool { return licenses[i].Key.String() < licenses[j].Key.String() })
+	return licenses, err
+}
+
+func (s *BoltStore) GetFile(tenant string, id string) (FileRecord, error) {
+	var record FileRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(filesBucket).Get([]byte(fileKey(tenant, id)))
+		if raw == nil {
+			return ErrFileNotFound
+		}
+		return json.Unmarshal(raw, &record)
+	})
+	return record, err
+}
+
+func (s *BoltStore) PutFile(record FileRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Put([]byte(fileKey(record.Tenant, record.ID)), raw)
+	})
+}
+
+func (s *BoltStore) UpdateFile(tenant string, id string, change func(record *FileRecord) error) (FileRecord, error) {
+	var record FileRecord
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+
+		raw := bucket.Get([]byte(fileKey(tenant, id)))
+		if raw == nil {
+			return ErrFileNotFound
+		}
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return err
+		}
+		if err := change(&record); err != nil {
+			return err
+		}
+
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fileKey(tenant, id)), raw)
+	})
+	return record, err
+}
+
+func (s *BoltStore) DeleteFile(tenant string, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		if bucket.Get([]byte(fileKey(tenant, id))) == nil {
+			return ErrFileNotFound
+		}
+		return bucket.Delete([]byte(fileKey(tenant, id)))
+	})
+}
+
+// ListFiles returns the files of the tenant. Keys start with the tenant, so
+// only its part of the bucket is read.
+func (s *BoltStore) ListFiles(tenant string) ([]FileRecord, error) {
+	files := []FileRecord{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(fileKey(tenant, ""))
+		cursor := tx.Bucket(filesBucket).Cursor()
+		for key, raw := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, raw = cursor.Next() {
+			var record FileRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return err
+			}
+			files = append(files, record)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (s *BoltStore) GetLink(id string) (LinkRecord, error) {
+	var link LinkRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(linksBucket).Get([]byte(id))
+		if raw == nil {
+			return ErrLinkNotFound
+		}
+		return json.Unmarshal(raw, &link)
+	})
+	return link, err
+}
+
+func (s *BoltStore) PutLink(link LinkRecord) error {
+	raw, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(linksBucket).Put([]byte(link.ID), raw)
+	})
+}
+
+func (s *BoltStore) ListLinks(licenseKey uuid.UUID) ([]LinkRecord, error) {
+	links := []LinkRecord{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(linksBucket).ForEach(func(_, raw []byte) error {
+			var link LinkRecord
+			if err := json.Unmarshal(raw, &link); err != nil {
+				return err
+			}
+			if link.LicenseKey == licenseKey {
+				links = append(links, link)
+			}
+			return nil
+		})
+	})
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+	return links, err
+}
+
+// updateLink loads the link, applies change and stores the result in a single
+// write transaction.
+func (s *BoltStore) updateLink(id string, change func(link *LinkRecord) error) (LinkRecord, error) {
+	var link LinkRecord
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(linksBucket)
+
+		raw := bucket.Get([]byte(id))
+		if raw == nil {
+			return ErrLinkNotFound
+		}
+		if err := json.Unmarshal(raw, &link); err != nil {
+			return err
+		}
+		if err := change(&link); err != nil {
+			return err
+		}
+
+		raw, err := json.Marshal(link)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), raw)
+	})
+	return link, err
+}
+
+func (s *BoltStore) UseLink(id string, now time.Time) (LinkRecord, error) {
+	return s.updateLink(id, func(link *LinkRecord) error {
+		if err := CheckLink(*link, now); err != nil {
+			return err
+		}
+		link.Downloads += 1
+		return nil
+	})
+}
+
+func (s *BoltStore) RevokeLink(id string, now time.Time) (LinkRecord, error) {
+	return s.updateLink(id, func(link *LinkRecord) error {
+		if link.RevokedAt == nil {
+			link.RevokedAt = &now
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) AcquireRate(key uuid.UUID, limits []RateLimit, operation string, bytes int64, now time.Time) (*RateStatus, error) {
+	var status *RateStatus
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ratesBucket)
+
+		counters := map[string]RateCounter{}
+		if raw := bucket.Get(key[:]); raw != nil {
+			if err := json.Unmarshal(raw, &counters); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if status, err = AcquireRate(counters, limits, operation, bytes, now); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(counters)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key[:], raw)
+	})
+	return status, err
+}
+
+func (s *BoltStore) RecordUsage(record UsageRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(binary.BigEndian.AppendUint64(record.LicenseKey[:], seq), raw)
+	})
+}
+
+func (s *BoltStore) ListUsage(licenseKey uuid.UUID) ([]UsageRecord, error) {
+	records := []UsageRecord{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(usageBucket).Cursor()
+		for key, raw := cursor.Seek(licenseKey[:]); key != nil && bytes.HasPrefix(key, licenseKey[:]); key, raw = cursor.Next() {
+			var record UsageRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *BoltStore) GetRotation(id string) (RotationJob, error) {
+	var job RotationJob
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(rotationsBucket).Get([]byte(id))
+		if raw == nil {
+			return ErrRotationNotFound
+		}
+		return json.Unmarshal(raw, &job)
+	})
+	return job, err
+}
+
+func (s *BoltStore) PutRotation(job RotationJob) error {
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(rotationsBucket).Put([]byte(job.ID), raw)
+	})
+}
+
+func (s *BoltStore) ListRotations() ([]RotationJob, error) {
+	jobs := []RotationJob{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rotationsBucket).ForEach(func(_, raw []byte) error {
+			var job RotationJob
+			if err := json.Unmarshal(raw, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
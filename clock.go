@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// Clock tells the current time. License and link expiry is only ever checked
+// against the clock of the server, so tests can move it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+// Now returns the current time in UTC, the zone all expiry dates are kept in.
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// addDays returns t moved by days of 24 hours. Days are counted in UTC, so
+// terms don't shrink or grow by an hour across daylight saving transitions
+// of the zone t was given in, and a date read back from the store extends
+// the same way as a fresh one.
+func addDays(t time.Time, days int) time.Time {
+	return t.UTC().AddDate(0, 0, days)
+}
+
+// expired reports whether the deadline has passed at now. A deadline is the
+// first instant something can't be used anymore, like the exp claim of a
+// token.
+func expired(deadline time.Time, now time.Time) bool {
+	return !now.Before(deadline)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const CONFIG_ENV = "SLES_CONFIG"
+
+// Config holds the server settings. Values are resolved in this order, later
+// ones winning: defaults, the JSON config file, SLES_* environment variables
+// and command line flags.
+type Config struct {
+	ListenAddr  string   `json:"listenAddr"`
+	BaseURL     string   `json:"baseURL"`
+	StorageDir  string   `json:"storageDir"`
+	LinkTTL     Duration `json:"linkTTL"`
+	LogLevel    string   `json:"logLevel"`
+	TLSCertFile string   `json:"tlsCertFile"`
+	TLSKeyFile  string   `json:"tlsKeyFile"`
+
+	// Where the master keys are kept. Only their location is configured,
+	// never the keys themselves.
+	KeyManager string `json:"keyManager"`
+	// Key manager files are being moved away from, see MigratingKeyManager
+	PreviousKeyManager string `json:"previousKeyManager"`
+	KeyringDir         string `json:"keyringDir"`
+	VaultAddr          string `json:"vaultAddr"`
+	VaultTransitMount  string `json:"vaultTransitMount"`
+	VaultTransitKey    string `json:"vaultTransitKey"`
+	VaultTokenFile     string `json:"vaultTokenFile"`
+
+	// API keys are only read from the config file
+	Credentials []Credential `json:"credentials"`
+}
+
+// Duration is a time.Duration written as "90m", "1h" etc. in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr: "localhost:3000",
+		BaseURL:    "http://localhost:3000",
+		StorageDir: "./encrypted_files",
+		LinkTTL:    Duration{time.Hour},
+		LogLevel:   "info",
+
+		KeyManager:        KEY_MANAGER_LOCAL,
+		VaultTransitMount: "transit",
+		VaultTransitKey:   "sles",
+	}
+}
+
+// configSetting binds one setting to its environment variable and flag.
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"SLES_LISTEN_ADDR", "listen", "address to listen on", func(cfg *Config, value string) error {
+		cfg.ListenAddr = value
+		return nil
+	}},
+	{"SLES_BASE_URL", "base-url", "public base URL used in generated links", func(cfg *Config, value string) error {
+		cfg.BaseURL = value
+		return nil
+	}},
+	{"SLES_STORAGE_DIR", "storage-dir", "directory for encrypted files and the database", func(cfg *Config, value string) error {
+		cfg.StorageDir = value
+		return nil
+	}},
+	{"SLES_LINK_TTL", "link-ttl", "lifetime of secure links, e.g. 30m or 24h", func(cfg *Config, value string) error {
+		ttl, err := time.ParseDuration(value)
+		cfg.LinkTTL = Duration{ttl}
+		return err
+	}},
+	{"SLES_LOG_LEVEL", "log-level", "log level (debug, info, warn, error)", func(cfg *Config, value string) error {
+		cfg.LogLevel = value
+		return nil
+	}},
+	{"SLES_TLS_CERT", "tls-cert", "TLS certificate file, enables HTTPS together with -tls-key", func(cfg *Config, value string) error {
+		cfg.TLSCertFile = value
+		return nil
+	}},
+	{"SLES_TLS_KEY", "tls-key", "TLS private key file", func(cfg *Config, value string) error {
+		cfg.TLSKeyFile = value
+		return nil
+	}},
+	{"SLES_KEY_MANAGER", "key-manager", "where master keys are kept (local, vault-transit)", func(cfg *Config, value string) error {
+		cfg.KeyManager = value
+		return nil
+	}},
+	{"SLES_PREVIOUS_KEY_MANAGER", "previous-key-manager", "key manager files are migrated from by key rotations", func(cfg *Config, value string) error {
+		cfg.PreviousKeyManager = value
+		return nil
+	}},
+	{"SLES_KEYRING_DIR", "keyring-dir", "directory of the master keys, outside the storage directory", func(cfg *Config, value string) error {
+		cfg.KeyringDir = value
+		return nil
+	}},
+	{"SLES_VAULT_ADDR", "vault-addr", "address of the Vault server, e.g. https://vault:8200", func(cfg *Config, value string) error {
+		cfg.VaultAddr = value
+		return nil
+	}},
+	{"SLES_VAULT_TRANSIT_MOUNT", "vault-transit-mount", "mount path of the transit engine", func(cfg *Config, value string) error {
+		cfg.VaultTransitMount = value
+		return nil
+	}},
+	{"SLES_VAULT_TRANSIT_KEY", "vault-transit-key", "name of the transit key", func(cfg *Config, value string) error {
+		cfg.VaultTransitKey = value
+		return nil
+	}},
+	{"SLES_VAULT_TOKEN_FILE", "vault-token-file", "file holding the Vault token, VAULT_TOKEN is used otherwise", func(cfg *Config, value string) error {
+		cfg.VaultTokenFile = value
+		return nil
+	}},
+}
+
+// LoadConfig builds the configuration from the config file, the environment
+// and the command line arguments (without the program name).
+func LoadConfig(args []string) (Config, error) {
+
+	cfg := DefaultConfig()
+
+	flags := flag.NewFlagSet("license-encryption-service", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(CONFIG_ENV), "path of the JSON config file")
+	flagValues := make(map[string]*string, len(configSettings))
+	for _, setting := range configSettings {
+		flagValues[setting.flag] = flags.String(setting.flag, "", setting.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		raw, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("Invalid config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, found := os.LookupEnv(setting.env); found {
+			if err := setting.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("Invalid %s: %w", setting.env, err)
+			}
+		}
+	}
+
+	// Only flags given on the command line override the values above
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name && flagErr == nil {
+				if err := setting.set(&cfg, *flagValues[f.Name]); err != nil {
+					flagErr = fmt.Errorf("Invalid -%s: %w", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the settings that can't be caught while parsing.
+func (cfg Config) Validate() error {
+
+	if cfg.ListenAddr == "" {
+		return errors.New("Listen address is required")
+	}
+	if cfg.StorageDir == "" {
+		return errors.New("Storage directory is required")
+	}
+	// A copy or backup of the storage directory must not carry the keys of
+	// the files in it
+	if cfg.KeyringDir == "" {
+		return errors.New("Keyring directory is required, keep it outside the storage directory")
+	}
+	if within(cfg.KeyringDir, cfg.StorageDir) {
+		return fmt.Errorf("Keyring directory %s is inside the storage directory %s", cfg.KeyringDir, cfg.StorageDir)
+	}
+
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("Base URL %q must be an absolute http(s) URL", cfg.BaseURL)
+	}
+
+	if cfg.LinkTTL.Duration <= 0 {
+		return errors.New("Link TTL must be positive")
+	}
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key file")
+	}
+
+	managers := []string{cfg.KeyManager}
+	if cfg.PreviousKeyManager != "" {
+		if cfg.PreviousKeyManager == cfg.KeyManager {
+			return errors.New("The previous key manager has to be a different one")
+		}
+		managers = append(managers, cfg.PreviousKeyManager)
+	}
+	for _, manager := range managers {
+		switch manager {
+		case KEY_MANAGER_LOCAL:
+		case KEY_MANAGER_VAULT_TRANSIT:
+			vault, err := url.Parse(cfg.VaultAddr)
+			if err != nil || (vault.Scheme != "http" && vault.Scheme != "https") || vault.Host == "" {
+				return fmt.Errorf("Vault address %q must be an absolute http(s) URL", cfg.VaultAddr)
+			}
+			if cfg.VaultTransitMount == "" || cfg.VaultTransitKey == "" {
+				return errors.New("Vault transit needs a mount and a key name")
+			}
+		default:
+			return fmt.Errorf("Unknown key manager %q, use %q or %q", manager, KEY_MANAGER_LOCAL, KEY_MANAGER_VAULT_TRANSIT)
+		}
+	}
+
+	keys := make(map[string]bool, len(cfg.Credentials))
+	for i, credential := range cfg.Credentials {
+		if credential.Name == "" {
+			return fmt.Errorf("Credential %d has no name", i)
+		}
+		if !validRole(credential.Role) {
+			return fmt.Errorf("Credential %s has unknown role %q", credential.Name, credential.Role)
+		}
+		if credential.Tenant != "" && !validTenant(credential.Tenant) {
+			return fmt.Errorf("Credential %s has invalid tenant %q", credential.Name, credential.Tenant)
+		}
+		if credential.Role == ROLE_OPERATOR && credential.Tenant != "" {
+			return fmt.Errorf("Operator credential %s can't act for a tenant", credential.Name)
+		}
+		if len(credential.Key) < MIN_API_KEY_LENGTH {
+			return fmt.Errorf("Credential %s key must be at least %d characters", credential.Name, MIN_API_KEY_LENGTH)
+		}
+		if keys[credential.Key] {
+			return fmt.Errorf("Credential %s reuses the key of another credential", credential.Name)
+		}
+		keys[credential.Key] = true
+	}
+
+	return nil
+}
+
+// TLSEnabled reports whether the server should serve HTTPS.
+func (cfg Config) TLSEnabled() bool {
+	return cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+}
+
+// within reports whether path is dir or lies below it, after resolving
+// relative paths and the symlinks of the parts that exist.
+func within(path string, dir string) bool {
+
+	resolve := func(path string) string {
+		path, _ = filepath.Abs(path)
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return resolved
+		}
+		return path
+	}
+
+	rel, err := filepath.Rel(resolve(dir), resolve(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// PublicURL joins path onto the public base URL.
+func (cfg Config) PublicURL(path string) string {
+	return strings.TrimSuffix(cfg.BaseURL, "/") + path
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// Encrypted files are written as a versioned container:
+//
+//	magic         [4]byte  "SLES"
+//	version       uint8
+//	algorithm     uint8
+//	chunkSize     uint32
+//	noncePrefix   [7]byte
+//	originalSize  uint64
+//	keyVersion    uint32   (version 3+)
+//	wrappedKeyLen uint16   (version 4+)
+//	wrappedKey    [wrappedKeyLen]byte (version 4+), [76]byte (versions 2 and 3)
+//
+// followed by one AEAD frame per chunk of plaintext (at least one, so empty
+// files still carry an authenticated frame). Frame i is sealed with the nonce
+// noncePrefix || uint32(i) || lastFlag and the encoded header as additional
+// data, so editing the header, reordering, dropping or truncating frames all
+// fail authentication. All integers are big endian.
+//
+// Version 2 files are encrypted with a random per-file data key, stored
+// wrapped by the key manager (see kms.go) under a version of the master key.
+// Version 4 stores the wrapped key in the key manager's own format, versions 2
+// and 3 in the local keyring's: kdfSalt [16], wrapNonce [12] and the sealed
+// key [48]. Version 2 files are wrapped under master key version 1. Version 1
+// files used sha256(licenseKey) directly and are still readable.
+//
+// Files without the magic bytes are treated as the legacy format: a bare
+// 16 byte IV followed by zero padded AES-CBC blocks.
+
+const CONTAINER_MAGIC = "SLES"
+const CONTAINER_VERSION = 4
+const ALG_AES256_GCM_CHUNKED = 1
+const CHUNK_SIZE = 64 * 1024
+const MAX_CHUNK_SIZE = 16 * 1024 * 1024
+const MAX_WRAPPED_KEY_SIZE = 4096
+
+const noncePrefixSize = 7
+const gcmNonceSize = 12
+const wrappedKeySize = DATA_KEY_SIZE + 16
+const fixedHeaderSize = 4 + 1 + 1 + 4 + noncePrefixSize + 8
+const keyVersionSize = 4
+const wrappedKeyLenSize = 2
+const keyBlockSize = KDF_SALT_SIZE + gcmNonceSize + wrappedKeySize
+
+var ErrCorruptedFile = NewAPIError(http.StatusUnprocessableEntity, "file_corrupted", "Encrypted file is corrupted or has been tampered with")
+var ErrUnsupportedFormat = NewAPIError(http.StatusUnprocessableEntity, "unsupported_format", "Unsupported encrypted file format")
+
+type containerHeader struct {
+	Version      uint8
+	Algorithm    uint8
+	ChunkSize    uint32
+	NoncePrefix  [noncePrefixSize]byte
+	OriginalSize uint64
+	KeyVersion   uint32
+	WrappedKey   []byte
+}
+
+// encodeFixed encodes the part of the header shared by all versions.
+func (h containerHeader) encodeFixed() []byte {
+	buf := make([]byte, 0, h.size())
+	buf = append(buf, CONTAINER_MAGIC...)
+	buf = append(buf, h.Version, h.Algorithm)
+	buf = binary.BigEndian.AppendUint32(buf, h.ChunkSize)
+	buf = append(buf, h.NoncePrefix[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, h.OriginalSize)
+	return buf
+}
+
+func (h containerHeader) encode() []byte {
+	buf := h.encodeFixed()
+	if h.Version >= 3 {
+		buf = binary.BigEndian.AppendUint32(buf, h.KeyVersion)
+	}
+	if h.Version >= 4 {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.WrappedKey)))
+	}
+	if h.Version >= 2 {
+		buf = append(buf, h.WrappedKey...)
+	}
+	return buf
+}
+
+func (h containerHeader) size() int {
+	switch {
+	case h.Version >= 4:
+		return fixedHeaderSize + keyVersionSize + wrappedKeyLenSize + len(h.WrappedKey)
+	case h.Version == 3:
+		return fixedHeaderSize + keyVersionSize + keyBlockSize
+	case h.Version == 2:
+		return fixedHeaderSize + keyBlockSize
+	}
+	return fixedHeaderSize
+}
+
+// readContainerHeader reads the header following the magic bytes and returns
+// it together with its encoding, which is the additional data of every frame.
+func readContainerHeader(r io.Reader) (containerHeader, []byte, error) {
+	var h containerHeader
+
+	raw := make([]byte, fixedHeaderSize)
+	copy(raw, CONTAINER_MAGIC)
+	if _, err := io.ReadFull(r, raw[len(CONTAINER_MAGIC):]); err != nil {
+		return h, nil, ErrCorruptedFile
+	}
+
+	h.Version = raw[4]
+	h.Algorithm = raw[5]
+	h.ChunkSize = binary.BigEndian.Uint32(raw[6:10])
+	copy(h.NoncePrefix[:], raw[10:17])
+	h.OriginalSize = binary.BigEndian.Uint64(raw[17:25])
+
+	if h.Version < 1 || h.Version > CONTAINER_VERSION || h.Algorithm != ALG_AES256_GCM_CHUNKED {
+		return h, nil, ErrUnsupportedFormat
+	}
+	if h.ChunkSize == 0 || h.ChunkSize > MAX_CHUNK_SIZE {
+		return h, nil, ErrCorruptedFile
+	}
+
+	// Files before version 3 are wrapped under the first master key
+	h.KeyVersion = 1
+	if h.Version >= 3 {
+		keyVersion := make([]byte, keyVersionSize)
+		if _, err := io.ReadFull(r, keyVersion); err != nil {
+			return h, nil, ErrCorruptedFile
+		}
+		h.KeyVersion = binary.BigEndian.Uint32(keyVersion)
+		raw = append(raw, keyVersion...)
+	}
+
+	wrappedLen := keyBlockSize
+	if h.Version >= 4 {
+		length := make([]byte, wrappedKeyLenSize)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return h, nil, ErrCorruptedFile
+		}
+		wrappedLen = int(binary.BigEndian.Uint16(length))
+		if wrappedLen == 0 || wrappedLen > MAX_WRAPPED_KEY_SIZE {
+			return h, nil, ErrCorruptedFile
+		}
+		raw = append(raw, length...)
+	}
+
+	if h.Version >= 2 {
+		h.WrappedKey = make([]byte, wrappedLen)
+		if _, err := io.ReadFull(r, h.WrappedKey); err != nil {
+			return h, nil, ErrCorruptedFile
+		}
+		raw = append(raw, h.WrappedKey...)
+	}
+
+	return h, raw, nil
+}
+
+// numChunks returns the number of frames in the container. An empty file
+// still has a single (empty) frame.
+func (h containerHeader) numChunks() uint64 {
+	if h.OriginalSize == 0 {
+		return 1
+	}
+	return (h.OriginalSize + uint64(h.ChunkSize) - 1) / uint64(h.ChunkSize)
+}
+
+// encryptedSize returns the expected size of the whole container on disk.
+func (h containerHeader) encryptedSize(overhead int) uint64 {
+	return uint64(h.size()) + h.OriginalSize + h.numChunks()*uint64(overhead)
+}
+
+// chunkNonce builds the nonce for frame i.
+func (h containerHeader) chunkNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 0, gcmNonceSize)
+	nonce = append(nonce, h.NoncePrefix[:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(i))
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// dataKey returns the key the frames of the file are encrypted with. The
+// wrapped key is bound to the fixed part of the header.
+func (h containerHeader) dataKey(keys KeyManager, license uuid.UUID) ([]byte, error) {
+	if h.Version == 1 {
+		return deriveFileKey(license), nil
+	}
+	return keys.Unwrap(license, WrappedKey{Version: h.KeyVersion, Ciphertext: h.WrappedKey}, h.encodeFixed())
+}
+
+// deriveFileKey hashes the UUID using SHA-256 to get a 32-byte AES key. Only
+// used by version 1 and legacy files.
+func deriveFileKey(key uuid.UUID) []byte {
+	hash := sha256.New()
+	hash.Write(key[:]) // Write the 16-byte UUID
+	return hash.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	cipherBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(cipherBlock)
+}
+
+// Meter is charged for plaintext as it is streamed through encryption or
+// decryption. An error stops the stream.
+type Meter interface {
+	Charge(n int64) error
+}
+
+// AESEncryption encrypts srcFile into destFile and returns the master key
+// version the data key is wrapped under. meter, if not nil, is charged for
+// every chunk before it is encrypted.
+func AESEncryption(keys KeyManager, key uuid.UUID, srcFile multipart.File, destFile io.Writer, meter Meter) (uint32, error) {
+
+	// Find the plaintext size, it's recorded in the header
+	size, err := srcFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return encryptStream(keys, key, size, srcFile, destFile, meter)
+}
+
+// encryptStream encrypts the size bytes read from src into dst, with a new
+// data key wrapped under the current master key version.
+func encryptStream(keys KeyManager, key uuid.UUID, size int64, src io.Reader, dst io.Writer, meter Meter) (uint32, error) {
+
+	header := containerHeader{
+		Version:      CONTAINER_VERSION,
+		Algorithm:    ALG_AES256_GCM_CHUNKED,
+		ChunkSize:    CHUNK_SIZE,
+		OriginalSize: uint64(size),
+	}
+
+	// Random nonce prefix, the frame counter makes each nonce unique
+	if _, err := io.ReadFull(rand.Reader, header.NoncePrefix[:]); err != nil {
+		return 0, err
+	}
+
+	// Random per-file data key, stored wrapped by the key manager
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return 0, err
+	}
+	wrapped, err := keys.Wrap(key, dataKey, header.encodeFixed())
+	if err != nil {
+		return 0, err
+	}
+	if len(wrapped.Ciphertext) == 0 || len(wrapped.Ciphertext) > MAX_WRAPPED_KEY_SIZE {
+		return 0, fmt.Errorf("Wrapped key of %d bytes doesn't fit the header", len(wrapped.Ciphertext))
+	}
+	header.KeyVersion = wrapped.Version
+	header.WrappedKey = wrapped.Ciphertext
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	rawHeader := header.encode()
+	if _, err := dst.Write(rawHeader); err != nil {
+		return 0, err
+	}
+
+	numChunks := header.numChunks()
+	if numChunks > 1<<32 {
+		return 0, errors.New("File is too large to encrypt")
+	}
+
+	buffer := make([]byte, header.ChunkSize, int(header.ChunkSize)+aead.Overhead())
+	remaining := header.OriginalSize
+
+	for i := uint64(0); i < numChunks; i++ {
+		chunk := buffer[:min(remaining, uint64(header.ChunkSize))]
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return 0, fmt.Errorf("Unable to read the source file: %w", err)
+		}
+		remaining -= uint64(len(chunk))
+
+		if meter != nil {
+			if err := meter.Charge(int64(len(chunk))); err != nil {
+				return 0, err
+			}
+		}
+
+		sealed := aead.Seal(chunk[:0], header.chunkNonce(i, i == numChunks-1), chunk, rawHeader)
+
+		// write encrypted frame to file
+		if _, err := dst.Write(sealed); err != nil {
+			return 0, err
+		}
+	}
+	return header.KeyVersion, nil
+}
+
+// EncryptedFile is an encrypted file whose header has been read and whose data
+// key has been unwrapped, ready to be decrypted.
+type EncryptedFile struct {
+	src       *os.File
+	key       uuid.UUID
+	legacy    bool
+	header    containerHeader
+	rawHeader []byte
+	aead      cipher.AEAD
+	size      int64
+	meter     Meter
+	// Range whose frames Verify already authenticated
+	verified *byteRange
+}
+
+// OpenEncryptedFile reads the header of srcFile and unwraps the data key. No
+// plaintext is produced yet, but truncated or extended files are rejected here.
+func OpenEncryptedFile(keys KeyManager, key uuid.UUID, srcFile *os.File) (*EncryptedFile, error) {
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(CONTAINER_MAGIC))
+	n, err := io.ReadFull(srcFile, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	// Anything without the magic bytes was written by the legacy CBC encrypter
+	if n < len(magic) || string(magic) != CONTAINER_MAGIC {
+		if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		// iv followed by a whole number of blocks
+		if info.Size() < aes.BlockSize || info.Size()%aes.BlockSize != 0 {
+			return nil, ErrCorruptedFile
+		}
+		return &EncryptedFile{src: srcFile, key: key, legacy: true, size: info.Size() - aes.BlockSize}, nil
+	}
+
+	header, rawHeader, err := readContainerHeader(srcFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := header.dataKey(keys, key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject truncated or extended files before emitting any plaintext
+	if uint64(info.Size()) != header.encryptedSize(aead.Overhead()) {
+		return nil, ErrCorruptedFile
+	}
+
+	return &EncryptedFile{
+		src:       srcFile,
+		key:       key,
+		header:    header,
+		rawHeader: rawHeader,
+		aead:      aead,
+		size:      int64(header.OriginalSize),
+	}, nil
+}
+
+// Size returns the length of the plaintext. For legacy files this includes the
+// zero padding of the last block.
+func (f *EncryptedFile) Size() int64 {
+	return f.size
+}
+
+// SetMeter makes WriteTo charge meter for the plaintext before writing it.
+func (f *EncryptedFile) SetMeter(meter Meter) {
+	f.meter = meter
+}
+
+// WriteTo decrypts the file into w. See WriteRange.
+func (f *EncryptedFile) WriteTo(w io.Writer) (int64, error) {
+	return f.WriteRange(w, 0, f.size)
+}
+
+// Verify authenticates the frames covering length bytes from offset without
+// releasing any plaintext. Legacy files carry no integrity information, they
+// always pass.
+func (f *EncryptedFile) Verify(offset int64, length int64) error {
+
+	if err := f.checkRange(offset, length); err != nil || f.legacy {
+		return err
+	}
+	if f.verified != nil && *f.verified == (byteRange{Start: offset, Length: length}) {
+		return nil
+	}
+	if err := f.openFrames(offset, length, func([]byte) error { return nil }); err != nil {
+		return err
+	}
+	f.verified = &byteRange{Start: offset, Length: length}
+	return nil
+}
+
+// WriteRange decrypts length bytes of plaintext starting at offset into w.
+// Only the frames covering the range are read, so seeking into a large file
+// costs no more than the bytes requested. All of them are authenticated
+// before the first byte is written, a tampered file produces no output. Each
+// frame is authenticated again as it is written, a file changed in between
+// cuts the output short but never releases unauthenticated data.
+func (f *EncryptedFile) WriteRange(w io.Writer, offset int64, length int64) (int64, error) {
+
+	if err := f.Verify(offset, length); err != nil {
+		return 0, err
+	}
+	if length == 0 && f.size > 0 {
+		return 0, nil
+	}
+	if f.meter != nil {
+		w = meteredWriter{w: w, meter: f.meter}
+	}
+
+	if f.legacy {
+		// Each CBC block is decrypted with the ciphertext before it, which
+		// for the first block is the IV at the start of the file
+		first := offset / aes.BlockSize
+		end := (offset + length + aes.BlockSize - 1) / aes.BlockSize
+		if _, err := f.src.Seek(first*aes.BlockSize, io.SeekStart); err != nil {
+			return 0, err
+		}
+		section := &sectionWriter{w: w, skip: offset - first*aes.BlockSize, remaining: length}
+		src := io.LimitReader(f.src, (end-first+1)*aes.BlockSize)
+		_, err := legacyAESDecryption(f.key, src, section)
+		return section.written, err
+	}
+
+	var written int64
+	err := f.openFrames(offset, length, func(plain []byte) error {
+		n, err := w.Write(plain)
+		written += int64(n)
+		return err
+	})
+	return written, err
+}
+
+func (f *EncryptedFile) checkRange(offset int64, length int64) error {
+	if offset < 0 || length < 0 || offset > f.size-length {
+		return fmt.Errorf("Range %d+%d is outside of the file", offset, length)
+	}
+	return nil
+}
+
+// openFrames reads and authenticates the frames covering length bytes from
+// offset and passes the plaintext of the range to fn, frame by frame. An
+// empty range of a non-empty file opens no frame.
+func (f *EncryptedFile) openFrames(offset int64, length int64, fn func(plain []byte) error) error {
+
+	if length == 0 && f.size > 0 {
+		return nil
+	}
+
+	header := f.header
+	chunkSize := uint64(header.ChunkSize)
+	numChunks := header.numChunks()
+	overhead := uint64(f.aead.Overhead())
+
+	first := uint64(offset) / chunkSize
+	last := first
+	if length > 0 {
+		last = uint64(offset+length-1) / chunkSize
+	}
+	frameStart := uint64(len(f.rawHeader)) + first*(chunkSize+overhead)
+	if _, err := f.src.Seek(int64(frameStart), io.SeekStart); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, chunkSize+overhead)
+	skip := uint64(offset) - first*chunkSize
+	remaining := uint64(length)
+
+	for i := first; i <= last; i++ {
+		plainLen := min(header.OriginalSize-i*chunkSize, chunkSize)
+		frame := buffer[:plainLen+overhead]
+		if _, err := io.ReadFull(f.src, frame); err != nil {
+			return ErrCorruptedFile
+		}
+
+		plain, err := f.aead.Open(frame[:0], header.chunkNonce(i, i == numChunks-1), frame, f.rawHeader)
+		if err != nil {
+			return ErrCorruptedFile
+		}
+		plain = plain[skip:]
+		plain = plain[:min(uint64(len(plain)), remaining)]
+		skip = 0
+		remaining -= uint64(len(plain))
+
+		if err := fn(plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectionWriter passes on the remaining bytes after the first skip ones and
+// drops the rest.
+type sectionWriter struct {
+	w         io.Writer
+	skip      int64
+	remaining int64
+	written   int64
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	size := len(p)
+	skip := min(s.skip, int64(len(p)))
+	p = p[skip:]
+	s.skip -= skip
+	p = p[:min(s.remaining, int64(len(p)))]
+
+	n, err := s.w.Write(p)
+	s.written += int64(n)
+	s.remaining -= int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// meteredWriter charges the meter for every write before passing it on.
+type meteredWriter struct {
+	w     io.Writer
+	meter Meter
+}
+
+func (m meteredWriter) Write(p []byte) (int, error) {
+	if err := m.meter.Charge(int64(len(p))); err != nil {
+		return 0, err
+	}
+	return m.w.Write(p)
+}
+
+// AESDecryption decrypts srcFile into destFile, charging meter if not nil.
+func AESDecryption(keys KeyManager, key uuid.UUID, srcFile *os.File, destFile io.Writer, meter Meter) error {
+
+	encrypted, err := OpenEncryptedFile(keys, key, srcFile)
+	if err != nil {
+		return err
+	}
+	encrypted.SetMeter(meter)
+
+	_, err = encrypted.WriteTo(destFile)
+	return err
+}
+
+// legacyAESDecryption decrypts files written before the container format was
+// introduced. These carry no length or integrity information, so the output
+// keeps the zero padding of the final block.
+func legacyAESDecryption(key uuid.UUID, srcFile io.Reader, destFile io.Writer) (int64, error) {
+	var written int64
+
+	// Read iv from encrypted file.
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(srcFile, iv); err != nil {
+		return written, ErrCorruptedFile
+	}
+
+	// Generate a new cipher with key(UUID)
+	cipherBlock, err := aes.NewCipher(deriveFileKey(key))
+	if err != nil {
+		return written, err
+	}
+
+	// Create CBC Decrypter using the cipherBlock(created with uuid as key)
+	blockMode := cipher.NewCBCDecrypter(cipherBlock, iv)
+
+	// Buffer for reading the input file in blocks
+	blockSize := cipherBlock.BlockSize()
+	buffer := make([]byte, blockSize)
+
+	for {
+		num_bytes_read, err := io.ReadFull(srcFile, buffer)
+		if err == io.EOF {
+			// Reached end of the file. decryption completed
+			break
+		}
+		if err == io.ErrUnexpectedEOF || num_bytes_read < blockSize {
+			// CBC output is always a whole number of blocks
+			return written, ErrCorruptedFile
+		}
+		if err != nil {
+			return written, err
+		}
+
+		//Decrypt the current chunk of data
+		blockMode.CryptBlocks(buffer, buffer)
+
+		// write decrypted data
+		n, err := destFile.Write(buffer)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -15,8 +15,74 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/sles/api/v1/encrypt-file": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get the encrypted files by id, with their original name and license key",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get the list of encrypted files with it's associated keys",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Encrypt the file using the provided license key. The id of the encrypted file is returned in the X-File-ID header.",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/octet-stream"
+                ],
+                "summary": "Encrypt the file",
+                "parameters": [
+                    {
+                        "type": "file",
+                        "description": "File to be uploaded",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "licensekey",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Encrypted file",
+                        "schema": {
+                            "type": "file"
+                        }
+                    }
+                }
+            }
+        },
         "/sles/api/v1/fetch-license": {
             "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
                 "description": "Get the list of license keys",
                 "consumes": [
                     "application/json"
@@ -34,7 +100,12 @@ const docTemplate = `{
         },
         "/sles/api/v1/generate-license": {
             "post": {
-                "description": "Create a new license key by providing a valid license type and expiry (e.g., days, num of tokens).",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Create a new license key by providing a valid license type and expiry (e.g., days, num of tokens). Hybrid licenses combine days with total, encrypt and decrypt token budgets, perpetual licenses have no limits. Any license may carry rolling-window 'rateLimits' and 'scopes' restricting its operations, file sizes, MIME types and files.",
                 "consumes": [
                     "application/json"
                 ],
@@ -44,7 +115,7 @@ const docTemplate = `{
                 "summary": "Generate license key",
                 "parameters": [
                     {
-                        "description": "License details. Specify 'type' as 'time-bound' or 'usage-limited'. For 'expiry', provide either days (e.g., 30) or tokens (e.g., 20).",
+                        "description": "License details. Specify 'type' as 'time-bound', 'usage-limited', 'hybrid' or 'perpetual'. For 'expiry', provide either days (e.g., 30) or tokens (e.g., 20). Hybrid licenses take any of 'days', 'tokens', 'encryptTokens' and 'decryptTokens' instead. 'notBefore' optionally delays the start.",
                         "name": "Request",
                         "in": "body",
                         "required": true,
@@ -60,16 +131,85 @@ const docTemplate = `{
                 }
             }
         },
-        "/sles/api/v1/encrypt-file": {
-            "get": {
-                "description": "Get the list of encrypted files",
+        "/sles/api/v1/generate-link": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Create a secure, shareable link to access the decrypted file.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get the list of encrypted files with it's associated keys",
+                "summary": "Generate secure URL",
+                "parameters": [
+                    {
+                        "description": "encrypted file id and license key for generating shareable URL",
+                        "name": "URLRequest",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.URLRequest"
+                        }
+                    }
+                ],
+                "responses": {}
+            }
+        },
+        "/sles/api/v1/key-manager": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get the key manager the master keys are kept in, the current master key version and the versions available. No key material is returned.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Describe the key manager",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/key-manager/rotate": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Add a new master key version to the key manager. New files are wrapped under it, existing files keep their version until a key rotation re-encrypts them. The master keys are shared by all tenants.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Rotate the master key",
+                "responses": {
+                    "201": {
+                        "description": "Created"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/key-rotations": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get the key rotation jobs of the tenant with their progress.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List key rotations",
                 "responses": {
                     "200": {
                         "description": "OK"
@@ -77,63 +217,372 @@ const docTemplate = `{
                 }
             },
             "post": {
-                "description": "Encrypt the file using the provided license key.",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Re-encrypt the files of a license ('licenseKey'), the files wrapped under a master key version or older ('keyVersion'), the files wrapped by a key manager ('keyManager'), or the files matching all of those given, with new data keys under the current master key version of the current key manager. New master key versions are added by operators with POST /key-manager/rotate. The job runs in the background, its progress is reported by GET /key-rotations/{id}.",
                 "consumes": [
-                    "multipart/form-data"
+                    "application/json"
                 ],
                 "produces": [
-                    "application/octet-stream"
+                    "application/json"
                 ],
-                "summary": "Encrypt the file",
+                "summary": "Start a key rotation",
                 "parameters": [
                     {
-                        "type": "file",
-                        "description": "File to be uploaded",
-                        "name": "file",
-                        "in": "formData",
-                        "required": true
-                    },
+                        "description": "Files to rotate",
+                        "name": "Request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.RotationRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/key-rotations/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get the status and progress of a key rotation job.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a key rotation",
+                "parameters": [
                     {
                         "type": "string",
-                        "description": "License key",
-                        "name": "licensekey",
-                        "in": "formData",
+                        "description": "Rotation id",
+                        "name": "id",
+                        "in": "path",
                         "required": true
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Encrypted file",
-                        "schema": {
-                            "type": "file"
-                        }
+                        "description": "OK"
                     }
                 }
             }
         },
-        
-        "/sles/api/v1/generate-link": {
+        "/sles/api/v1/key-rotations/{id}/resume": {
             "post": {
-                "description": "Create a secure, shareable link to access the decrypted file.",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Continue a failed key rotation job after the last file it processed. Jobs interrupted by a restart are resumed automatically.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Resume a key rotation",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Rotation id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/license-keys": {
+            "get": {
+                "description": "The public keys license tokens are signed with, as a JSON Web Key Set. Client applications use them to verify license tokens offline.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "License token keys",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/licenses/{key}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get the license with its status, expiry and remaining tokens.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a license",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Delete the license. Files encrypted with it can't be decrypted anymore.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete a license",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            },
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Extend the expiry of a license by 'extendDays', or add 'addTokens', 'addEncryptTokens' or 'addDecryptTokens' to its token budgets and 'addBytes' to its byte budget. Only limits the license has can be extended. Expired licenses are extended from today. Revoked licenses can't be changed.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Generate secure URL",
+                "summary": "Extend a license",
                 "parameters": [
                     {
-                        "description": "encrypted file path and license key for generating shareable URL",
-                        "name": "URLRequest",
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Days or tokens to add",
+                        "name": "Request",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.URLRequest"
+                            "$ref": "#/definitions/main.LicenseUpdate"
                         }
                     }
                 ],
-                "responses": {}
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/licenses/{key}/resume": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Make a suspended license active again.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Resume a license",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/licenses/{key}/revoke": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Revoke the license permanently. The license stays on record but can never be used again.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Revoke a license",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/licenses/{key}/suspend": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Suspend the license until it's resumed. Suspended licenses can't encrypt, decrypt or share files.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Suspend a license",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/licenses/{key}/usage": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the bytes each encryption and decryption with the license consumed, with the totals per operation.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get the usage of a license",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/links": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get the active (not expired, revoked or used up) secure links created with the license key.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List secure links",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "License key",
+                        "name": "licensekey",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/sles/api/v1/links/{id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Revoke the secure link immediately. The license and its other links stay valid.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Revoke a secure link",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Link id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "License key the link was created with",
+                        "name": "licensekey",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
             }
         }
     },
@@ -141,33 +590,157 @@ const docTemplate = `{
         "main.LicenseRequest": {
             "type": "object",
             "required": [
-                "expiry",
                 "type"
             ],
             "properties": {
+                "bytes": {
+                    "type": "integer"
+                },
+                "days": {
+                    "type": "integer"
+                },
+                "decryptTokens": {
+                    "type": "integer"
+                },
+                "encryptTokens": {
+                    "type": "integer"
+                },
                 "expiry": {
                     "type": "integer"
                 },
+                "features": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "notBefore": {
+                    "type": "string"
+                },
+                "rateLimits": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.RateLimit"
+                    }
+                },
+                "scopes": {
+                    "$ref": "#/definitions/main.LicenseScopes"
+                },
+                "signed": {
+                    "type": "boolean"
+                },
+                "tokens": {
+                    "type": "integer"
+                },
                 "type": {
                     "type": "string"
                 }
             }
         },
+        "main.LicenseScopes": {
+            "type": "object",
+            "properties": {
+                "fileIds": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "maxFileSize": {
+                    "type": "integer"
+                },
+                "mimeTypes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "operations": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.LicenseUpdate": {
+            "type": "object",
+            "properties": {
+                "addBytes": {
+                    "type": "integer"
+                },
+                "addDecryptTokens": {
+                    "type": "integer"
+                },
+                "addEncryptTokens": {
+                    "type": "integer"
+                },
+                "addTokens": {
+                    "type": "integer"
+                },
+                "extendDays": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.RateLimit": {
+            "type": "object",
+            "properties": {
+                "maxBytes": {
+                    "type": "integer"
+                },
+                "maxRequests": {
+                    "type": "integer"
+                },
+                "operation": {
+                    "type": "string"
+                },
+                "window": {
+                    "type": "string",
+                    "example": "1h"
+                }
+            }
+        },
+        "main.RotationRequest": {
+            "type": "object",
+            "properties": {
+                "keyManager": {
+                    "description": "Selects the files wrapped by this key manager, to move them to the\ncurrent one",
+                    "type": "string"
+                },
+                "keyVersion": {
+                    "type": "integer"
+                },
+                "licenseKey": {
+                    "type": "string"
+                }
+            }
+        },
         "main.URLRequest": {
             "type": "object",
             "required": [
-                "filepath",
+                "fileid",
                 "licensekey"
             ],
             "properties": {
-                "filepath": {
+                "fileid": {
                     "type": "string"
                 },
                 "licensekey": {
                     "type": "string"
+                },
+                "maxDownloads": {
+                    "type": "integer"
                 }
             }
         }
+    },
+    "securityDefinitions": {
+        "ApiKeyAuth": {
+            "type": "apiKey",
+            "name": "X-API-Key",
+            "in": "header"
+        }
     }
 }`
 
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/sirupsen/logrus"
+)
+
+// APIError is the error type shared by the handlers and the layers below them.
+// Code is a stable identifier clients can match on, Status the HTTP status it
+// is rendered with.
+type APIError struct {
+	Code    string `json:"code"`
+	Status  int    `json:"-"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+	cause   error
+}
+
+func NewAPIError(status int, code string, message string) *APIError {
+	return &APIError{Code: code, Status: status, Message: message}
+}
+
+func (e *APIError) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.cause
+}
+
+// Is matches errors by code, so copies made by WithDetails and Wrap still
+// match the sentinel they came from.
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Code == e.Code
+}
+
+// WithDetails returns a copy of the error carrying extra details for the client.
+func (e *APIError) WithDetails(details any) *APIError {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+// Wrap returns a copy of the error with the underlying cause attached. The
+// cause is logged but never sent to the client.
+func (e *APIError) Wrap(cause error) *APIError {
+	copied := *e
+	copied.cause = cause
+	return &copied
+}
+
+var ErrInvalidRequest = NewAPIError(http.StatusBadRequest, "invalid_request", "Couldn't parse request")
+var ErrMissingFields = NewAPIError(http.StatusBadRequest, "missing_fields", "Mandatory fields are not present")
+var ErrInvalidLicenseKey = NewAPIError(http.StatusBadRequest, "invalid_license_key", "Couldn't parse license key")
+var ErrUnsupportedLicenseType = NewAPIError(http.StatusBadRequest, "unsupported_license_type", "Unsupported license type. Specify 'type' as 'time-bound', 'usage-limited', 'hybrid' or 'perpetual'")
+var ErrInvalidExpiry = NewAPIError(http.StatusBadRequest, "invalid_expiry", "Invalid expiry. Please provide either days (e.g., 30) or tokens (e.g., 20), hybrid licenses any of days, tokens, encryptTokens and decryptTokens")
+var ErrInvalidMaxDownloads = NewAPIError(http.StatusBadRequest, "invalid_max_downloads", "Invalid maxDownloads. Provide a positive number, or 0 for unlimited downloads")
+var ErrIncorrectKey = NewAPIError(http.StatusForbidden, "incorrect_key", "Incorrect key")
+var ErrInternal = NewAPIError(http.StatusInternalServerError, "internal_error", "Internal server error")
+
+// AsAPIError converts any error into an APIError. Errors from outside the
+// model become internal errors, their text is only logged.
+func AsAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return ErrInternal.Wrap(err)
+}
+
+// BindError converts a request binding error. Fields failing their binding
+// rules are listed in the details.
+func BindError(err error) *APIError {
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		fields := make([]string, 0, len(invalid))
+		for _, field := range invalid {
+			fields = append(fields, field.Field())
+		}
+		return ErrMissingFields.WithDetails(gin.H{"fields": fields})
+	}
+	return ErrInvalidRequest.WithDetails(err.Error())
+}
+
+// ErrorHandler renders the last error a handler attached with c.Error. Handlers
+// attach the error and return, this is the only place writing error bodies.
+func ErrorHandler(log logrus.FieldLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 {
+			return
+		}
+
+		apiErr := AsAPIError(c.Errors.Last().Err)
+		log.WithField("code", apiErr.Code).WithField("path", c.Request.URL.Path).Error(apiErr.Error())
+
+		// Streaming responses can fail after the headers went out
+		if c.Writer.Written() {
+			return
+		}
+		c.IndentedJSON(apiErr.Status, apiErr)
+	}
+}
+
+// abortWithError attaches err for ErrorHandler and stops the handler chain.
+func abortWithError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
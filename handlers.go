@@ -1,10 +1,12 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"time"
 
@@ -19,139 +21,548 @@ import (
 // @Accept json
 // @Produce json
 // @Success 200
+// @Security ApiKeyAuth
 // @Router /sles/api/v1/fetch-license [get]
-func GetLicense(c *gin.Context) {
-	LOG.Info("Fetched licenses successfully")
-	c.IndentedJSON(http.StatusOK, Licenses)
+func (s *Server) GetLicense(c *gin.Context) {
+	licenses, err := s.Licenses.ListLicenses(callerTenant(c))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	response := make(map[uuid.UUID]License, len(licenses))
+	for _, license := range licenses {
+		response[license.Key] = license
+	}
+
+	s.Log.Info("Fetched licenses successfully")
+	c.IndentedJSON(http.StatusOK, response)
 
 }
 
 // @Summary Get the list of encrypted files with it's associated keys
-// @Description Get the list of encrypted files
+// @Description Get the encrypted files by id, with their original name and license key
 // @Accept json
 // @Produce json
 // @Success 200
+// @Security ApiKeyAuth
 // @Router /sles/api/v1/encrypt-file [get]
-func GetEncryptedFiles(c *gin.Context) {
-	LOG.Info("Fetched encrypted files successfully")
-	c.IndentedJSON(http.StatusOK, File)
+func (s *Server) GetEncryptedFiles(c *gin.Context) {
+	files, err := s.Files.ListFiles(callerTenant(c))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	response := make(map[string]FileRecord, len(files))
+	for _, record := range files {
+		response[record.ID] = record
+	}
+
+	s.Log.Info("Fetched encrypted files successfully")
+	c.IndentedJSON(http.StatusOK, response)
 
 }
 
 // @Summary Generate license key
-// @Description Create a new license key by providing a valid license type and expiry (e.g., days, num of tokens).
+// @Description Create a new license key by providing a valid license type and expiry (e.g., days, num of tokens). Hybrid licenses combine days with total, encrypt and decrypt token budgets, perpetual licenses have no limits. Any license may carry rolling-window 'rateLimits' and 'scopes' restricting its operations, file sizes, MIME types and files.
 // @Accept json
-// @Param Request body LicenseRequest true "License details. Specify 'type' as 'time-bound' or 'usage-limited'. For 'expiry', provide either days (e.g., 30) or tokens (e.g., 20)."
+// @Param Request body LicenseRequest true "License details. Specify 'type' as 'time-bound', 'usage-limited', 'hybrid' or 'perpetual'. For 'expiry', provide either days (e.g., 30) or tokens (e.g., 20). Hybrid licenses take any of 'days', 'tokens', 'encryptTokens' and 'decryptTokens' instead. 'notBefore' optionally delays the start."
 // @Produce json
 // @Success 201
+// @Security ApiKeyAuth
 // @Router /sles/api/v1/generate-license [post]
-func GenerateLicense(c *gin.Context) {
+func (s *Server) GenerateLicense(c *gin.Context) {
 	var reqBody LicenseRequest
 	var newLicense License
 
-	if err := c.BindJSON(&reqBody); err != nil {
-		LOG.Error("Unable to parse request body. Error: ", err.Error())
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Unable to parse request body"})
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		abortWithError(c, BindError(err))
+		return
+	}
 
+	newLicense = License{}
+	if err := applyLicenseTerms(&newLicense, reqBody, s.Clock.Now()); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	newLicense.Key = uuid.New()
+	newLicense.Tenant = callerTenant(c)
+	newLicense.Status = LICENSE_ACTIVE
+	if reqBody.Signed {
+		token, err := s.SignLicense(newLicense)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		newLicense.Token = token
 	}
 
-	licenseType := strings.ToLower(reqBody.Type)
+	if err := s.Licenses.PutLicense(newLicense); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("License key generated successfully")
+	c.IndentedJSON(http.StatusCreated, newLicense)
 
-	if licenseType != TIME_BOUND && licenseType != USAGE_LIMITED {
-		LOG.Error("Unsupported license type. Provided type: ", licenseType)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Unsupported license type. Specify 'type' as 'time-bound' or 'usage-limited'"})
+}
+
+// applyLicenseTerms sets the type and limits of a new license. Days are
+// counted from the start of the license, notBefore if given.
+func applyLicenseTerms(license *License, reqBody LicenseRequest, now time.Time) error {
+
+	license.Type = strings.ToLower(reqBody.Type)
+	days, tokens := 0, 0
+
+	switch license.Type {
+	case TIME_BOUND:
+		if reqBody.Expiry <= 0 {
+			return ErrInvalidExpiry
+		}
+		days = reqBody.Expiry
+	case USAGE_LIMITED:
+		if reqBody.Expiry <= 0 {
+			return ErrInvalidExpiry
+		}
+		tokens = reqBody.Expiry
+	case HYBRID:
+		if reqBody.Expiry != 0 || reqBody.Days < 0 || reqBody.Tokens < 0 || reqBody.EncryptTokens < 0 || reqBody.DecryptTokens < 0 || reqBody.Bytes < 0 ||
+			reqBody.Days+reqBody.Tokens+reqBody.EncryptTokens+reqBody.DecryptTokens == 0 && reqBody.Bytes == 0 {
+			return ErrInvalidExpiry
+		}
+		days, tokens = reqBody.Days, reqBody.Tokens
+		if reqBody.EncryptTokens > 0 {
+			license.EncryptTokensLeft = budget(reqBody.EncryptTokens)
+		}
+		if reqBody.DecryptTokens > 0 {
+			license.DecryptTokensLeft = budget(reqBody.DecryptTokens)
+		}
+		if reqBody.Bytes > 0 {
+			license.BytesLeft = budget(reqBody.Bytes)
+		}
+	case PERPETUAL:
+		if reqBody.Expiry != 0 {
+			return ErrInvalidExpiry.WithDetails(gin.H{"type": PERPETUAL})
+		}
+	default:
+		return ErrUnsupportedLicenseType.WithDetails(gin.H{"type": reqBody.Type})
 	}
 
-	if reqBody.Expiry <= 0 {
-		LOG.Error("Invalid expiry. please provide positive numbers")
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid expiry. Please provide either days (e.g., 30) or tokens (e.g., 20)"})
+	if license.Type != HYBRID && (reqBody.Days != 0 || reqBody.Tokens != 0 || reqBody.EncryptTokens != 0 || reqBody.DecryptTokens != 0 || reqBody.Bytes != 0) {
+		return ErrInvalidExpiry.WithDetails(gin.H{"type": license.Type})
 	}
 
-	newLicense = License{}
-	newLicense.Key = uuid.New()
-	newLicense.Type = licenseType
-	if licenseType == TIME_BOUND {
-		newLicense.ExpiryDate = time.Now().AddDate(0, 0, reqBody.Expiry)
-	} else {
-		newLicense.TokensLeft = reqBody.Expiry
+	start := now
+	if reqBody.NotBefore != nil {
+		start = reqBody.NotBefore.UTC()
+		license.NotBefore = &start
+	}
+	if days > 0 {
+		license.ExpiryDate = addDays(start, days)
+	}
+	if tokens > 0 {
+		license.TokensLeft = budget(tokens)
 	}
 
-	Licenses[newLicense.Key] = newLicense
+	for _, limit := range reqBody.RateLimits {
+		if !validRateLimit(limit) {
+			return ErrInvalidRateLimit.WithDetails(gin.H{"rateLimit": limit})
+		}
+	}
+	license.RateLimits = reqBody.RateLimits
 
-	LOG.Info("License key generated successfully")
-	c.IndentedJSON(http.StatusCreated, newLicense)
+	if slices.Contains(reqBody.Features, "") {
+		return ErrInvalidRequest.WithDetails(gin.H{"features": reqBody.Features})
+	}
+	license.Features = reqBody.Features
+
+	if reqBody.Scopes != nil && !validScopes(*reqBody.Scopes) {
+		return ErrInvalidScopes.WithDetails(gin.H{"scopes": reqBody.Scopes})
+	}
+	license.Scopes = reqBody.Scopes
+	return nil
+}
+
+// updateTenantLicense applies change to the caller's license named by the key
+// path parameter, atomically in the store.
+func (s *Server) updateTenantLicense(c *gin.Context, change func(license *License) error) (License, error) {
+
+	key, err := s.ParseLicenseKey(c.Param("key"))
+	if err != nil {
+		return License{}, err
+	}
+
+	tenant := callerTenant(c)
+	return s.Licenses.UpdateLicense(key, func(license *License) error {
+		if license.Tenant != tenant {
+			return ErrLicenseNotFound
+		}
+		return change(license)
+	})
+}
+
+// @Summary Get a license
+// @Description Get the license with its status, expiry and remaining tokens.
+// @Produce json
+// @Param key path string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key} [get]
+func (s *Server) GetLicenseDetails(c *gin.Context) {
+
+	key, err := s.ParseLicenseKey(c.Param("key"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	license, err := s.Licenses.GetLicense(key)
+	if err == nil && license.Tenant != callerTenant(c) {
+		err = ErrLicenseNotFound
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, license)
+
+}
+
+// @Summary Get the usage of a license
+// @Description List the bytes each encryption and decryption with the license consumed, with the totals per operation.
+// @Produce json
+// @Param key path string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key}/usage [get]
+func (s *Server) GetLicenseUsage(c *gin.Context) {
+
+	key, err := s.ParseLicenseKey(c.Param("key"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	license, err := s.Licenses.GetLicense(key)
+	if err == nil && license.Tenant != callerTenant(c) {
+		err = ErrLicenseNotFound
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	records, err := s.Usage.ListUsage(key)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	totals := map[string]int64{OP_ENCRYPT: 0, OP_DECRYPT: 0}
+	for _, record := range records {
+		totals[record.Operation] += record.Bytes
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"key": key, "bytesLeft": license.BytesLeft, "totalBytes": totals, "operations": records})
+
+}
+
+// @Summary Extend a license
+// @Description Extend the expiry of a license by 'extendDays', or add 'addTokens', 'addEncryptTokens' or 'addDecryptTokens' to its token budgets and 'addBytes' to its byte budget. Only limits the license has can be extended. Expired licenses are extended from today. Revoked licenses can't be changed.
+// @Accept json
+// @Produce json
+// @Param key path string true "License key"
+// @Param Request body LicenseUpdate true "Days or tokens to add"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key} [patch]
+func (s *Server) UpdateLicenseTerms(c *gin.Context) {
+	var reqBody LicenseUpdate
+
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		abortWithError(c, BindError(err))
+		return
+	}
+
+	now := s.Clock.Now()
+	license, err := s.updateTenantLicense(c, func(license *License) error {
+		if license.Status == LICENSE_REVOKED {
+			return ErrLicenseStatus.WithDetails(gin.H{"status": license.Status})
+		}
+
+		invalid := ErrInvalidLicenseUpdate.WithDetails(gin.H{"type": license.Type})
+		if reqBody == (LicenseUpdate{}) {
+			return invalid
+		}
+
+		if reqBody.ExtendDays != 0 {
+			if reqBody.ExtendDays < 0 || license.ExpiryDate.IsZero() {
+				return invalid
+			}
+			if expired(license.ExpiryDate, now) {
+				license.ExpiryDate = now
+			}
+			license.ExpiryDate = addDays(license.ExpiryDate, reqBody.ExtendDays)
+		}
+
+		budgets := []struct {
+			add  int
+			left **int
+		}{
+			{reqBody.AddTokens, &license.TokensLeft},
+			{reqBody.AddEncryptTokens, &license.EncryptTokensLeft},
+			{reqBody.AddDecryptTokens, &license.DecryptTokensLeft},
+		}
+		for _, b := range budgets {
+			if b.add == 0 {
+				continue
+			}
+			if b.add < 0 || *b.left == nil {
+				return invalid
+			}
+			*b.left = budget(**b.left + b.add)
+		}
+
+		if reqBody.AddBytes != 0 {
+			if reqBody.AddBytes < 0 || license.BytesLeft == nil {
+				return invalid
+			}
+			license.BytesLeft = budget(*license.BytesLeft + reqBody.AddBytes)
+		}
+
+		// Tokens carry the terms, issue a new one with the extended terms
+		if license.Token != "" {
+			token, err := s.SignLicense(*license)
+			if err != nil {
+				return err
+			}
+			license.Token = token
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("License updated. Key: ", license.Key)
+	c.IndentedJSON(http.StatusOK, license)
+
+}
+
+// setLicenseStatus moves the license to status. Revoking is final, revoked
+// licenses can't be suspended or resumed.
+func (s *Server) setLicenseStatus(c *gin.Context, status string) {
+
+	license, err := s.updateTenantLicense(c, func(license *License) error {
+		if license.Status == LICENSE_REVOKED && status != LICENSE_REVOKED {
+			return ErrLicenseStatus.WithDetails(gin.H{"status": license.Status})
+		}
+		license.Status = status
+		return nil
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("License status changed to ", status, ". Key: ", license.Key)
+	c.IndentedJSON(http.StatusOK, license)
+
+}
+
+// @Summary Suspend a license
+// @Description Suspend the license until it's resumed. Suspended licenses can't encrypt, decrypt or share files.
+// @Produce json
+// @Param key path string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key}/suspend [post]
+func (s *Server) SuspendLicense(c *gin.Context) {
+	s.setLicenseStatus(c, LICENSE_SUSPENDED)
+}
+
+// @Summary Resume a license
+// @Description Make a suspended license active again.
+// @Produce json
+// @Param key path string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key}/resume [post]
+func (s *Server) ResumeLicense(c *gin.Context) {
+	s.setLicenseStatus(c, LICENSE_ACTIVE)
+}
+
+// @Summary Revoke a license
+// @Description Revoke the license permanently. The license stays on record but can never be used again.
+// @Produce json
+// @Param key path string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key}/revoke [post]
+func (s *Server) RevokeLicense(c *gin.Context) {
+	s.setLicenseStatus(c, LICENSE_REVOKED)
+}
+
+// @Summary Delete a license
+// @Description Delete the license. Files encrypted with it can't be decrypted anymore.
+// @Produce json
+// @Param key path string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/licenses/{key} [delete]
+func (s *Server) DeleteLicense(c *gin.Context) {
+
+	key, err := s.ParseLicenseKey(c.Param("key"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	license, err := s.Licenses.GetLicense(key)
+	if err == nil && license.Tenant != callerTenant(c) {
+		err = ErrLicenseNotFound
+	}
+	if err == nil {
+		err = s.Licenses.DeleteLicense(key)
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("License deleted. Key: ", key)
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "License deleted", "key": key})
 
 }
 
 // @Summary Encrypt the file
-// @Description Encrypt the file using the provided license key.
+// @Description Encrypt the file using the provided license key. The id of the encrypted file is returned in the X-File-ID header.
 // @Accept multipart/form-data
 // @Param file formData file true "File to be uploaded"
 // @Param licensekey formData string true "License key"
 // @Produce application/octet-stream
 // @Success 200 {file} file "Encrypted file"
+// @Security ApiKeyAuth
 // @Router /sles/api/v1/encrypt-file [post]
-func EncryptFile(c *gin.Context) {
+func (s *Server) EncryptFile(c *gin.Context) {
 	var reqForm FormRequest
-	var key uuid.UUID
-	var err error
-	var licenseData License
 
 	if err := c.ShouldBind(&reqForm); err != nil {
-		LOG.Error("Couldn't parse request. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Couldn't parse request.", "error": err.Error()})
-
-	}
-	fmt.Println(reqForm)
-	if key, err = uuid.Parse(reqForm.LicenseKey); err != nil {
-		LOG.Error("Couldn't parse license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Couldn't parse license key.", "error": err.Error()})
-
+		abortWithError(c, BindError(err))
+		return
 	}
 
 	// Validate the license
-	if licenseData, err = ValidateLicenseKey(key); err != nil {
-		LOG.Error("Failed to validate license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusForbidden, gin.H{"message": err.Error()})
+	tenant := callerTenant(c)
+	license, err := s.ValidateLicenseKey(tenant, reqForm.LicenseKey, OP_ENCRYPT)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	key := license.Key
+
+	// The client's file name is only metadata, the file is stored under its id
+	originalName := SanitizeFileName(reqForm.File.Filename)
+	contentType := DetectContentType(originalName, reqForm.File.Header.Get("Content-Type"))
+	if err := license.AllowsOperation(OP_ENCRYPT); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := license.AllowsContent(reqForm.File.Size, contentType); err != nil {
+		abortWithError(c, err)
+		return
+	}
 
+	if err := s.acquireLicenseRate(c, license, OP_ENCRYPT, reqForm.File.Size); err != nil {
+		abortWithError(c, err)
+		return
 	}
 
 	srcFile, err := reqForm.File.Open()
 	if err != nil {
-		LOG.Error("unable to parse the file. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "unable to parse the file", "error": err.Error()})
-
+		abortWithError(c, ErrInvalidRequest.Wrap(err))
+		return
 	}
+	defer srcFile.Close()
 
-	FileName := strings.TrimSuffix(reqForm.File.Filename, filepath.Ext(reqForm.File.Filename)) + ".enc"
-	encryptedFileName := filepath.Join(OUTPUTDIR, FileName)
+	fileID := uuid.NewString()
+	blobPath := tenantPath(tenant, fileID+".enc")
 
 	// Create file to save encrypted data
-	destFile, err := os.Create(encryptedFileName)
+	destFile, err := s.Blobs.Create(blobPath)
 	if err != nil {
-		LOG.Error("unable to create the dest file. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "unable to create the dest file", "error": err.Error()})
+		abortWithError(c, err)
+		return
+	}
+	defer destFile.Close()
+	encryptedFileName := destFile.Name()
 
+	// Uploads that don't fit into the byte budget are refused up front
+	meter, err := s.newLicenseMeter(license, reqForm.File.Size)
+	if err != nil {
+		destFile.Close()
+		os.Remove(encryptedFileName)
+		abortWithError(c, err)
+		return
 	}
 
-	if err = AESEncryption(key, srcFile, destFile); err != nil {
-		LOG.Error("Error occurred while encrypting file. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Error occurred while encrypting file", "error": err.Error()})
+	keyVersion, err := AESEncryption(s.Keys, key, srcFile, destFile, meter)
 
+	// Uploads over the multipart memory limit are spooled to temp files. Drop
+	// the plaintext as soon as it is encrypted, before the response is sent.
+	srcFile.Close()
+	if c.Request.MultipartForm != nil {
+		c.Request.MultipartForm.RemoveAll()
 	}
 
-	// If it's usage bases, update the tokens
-	if licenseData.Type == USAGE_LIMITED {
-		licenseData.TokensLeft -= 1
-		Licenses[key] = licenseData
+	if err != nil {
+		meter.settle(false)
+		destFile.Close()
+		os.Remove(encryptedFileName)
+		abortWithError(c, err)
+		return
 	}
 
-	File[FileName] = key
+	// Register the file before spending the token, a file that can't be
+	// registered could never be fetched and must not be charged
+	record := FileRecord{
+		ID:           fileID,
+		Tenant:       tenant,
+		Path:         blobPath,
+		LicenseKey:   key,
+		OriginalName: originalName,
+		ContentType:  contentType,
+		CreatedAt:    s.Clock.Now(),
+		KeyVersion:   keyVersion,
+		KeyManager:   s.Config.KeyManager,
+	}
+	if err := s.Files.PutFile(record); err != nil {
+		meter.settle(false)
+		destFile.Close()
+		os.Remove(encryptedFileName)
+		abortWithError(c, err)
+		return
+	}
 
-	c.FileAttachment(encryptedFileName, FileName)
+	// Spend the token once the work is done. Consuming re-validates the license
+	// atomically, concurrent requests may have used up the last token meanwhile.
+	if _, err := s.ConsumeLicense(key, OP_ENCRYPT); err != nil {
+		if deleteErr := s.Files.DeleteFile(tenant, fileID); deleteErr != nil {
+			s.Log.Error("Unable to unregister file ", fileID, ". Error: ", deleteErr.Error())
+		}
+		meter.settle(false)
+		destFile.Close()
+		os.Remove(encryptedFileName)
+		abortWithError(c, err)
+		return
+	}
+	s.recordUsage(c, license, OP_ENCRYPT, fileID, meter.settle(true), true)
 
-	defer srcFile.Close()
-	defer destFile.Close()
+	c.Header(FILE_ID_HEADER, fileID)
+	c.FileAttachment(encryptedFileName, strings.TrimSuffix(originalName, filepath.Ext(originalName))+".enc")
 
 }
 
@@ -159,48 +570,153 @@ func EncryptFile(c *gin.Context) {
 // @Description Create a secure, shareable link to access the decrypted file.
 // @Accept json
 // @Produce json
-// @Param URLRequest body URLRequest true "encrypted file path and license key for generating shareable URL"
+// @Param URLRequest body URLRequest true "encrypted file id and license key for generating shareable URL"
 // @Sucess 200
+// @Security ApiKeyAuth
 // @Router /sles/api/v1/generate-link [post]
-func GenerateSecureURL(c *gin.Context) {
+func (s *Server) GenerateSecureURL(c *gin.Context) {
 	var reqBody URLRequest
-	var err error
-	var key uuid.UUID
-
-	if err = c.ShouldBindJSON(&reqBody); err != nil {
-		LOG.Error("Unable to parse request body. Error: ", err.Error())
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Unable to parse request body"})
 
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		abortWithError(c, BindError(err))
+		return
 	}
 
 	licenseKey := reqBody.LicenseKey
-	filePath := reqBody.FilePath
+	fileID := reqBody.FileID
 
-	if licenseKey == "" || filePath == "" {
-		LOG.Error("Mandatory fields are not present. licensekey, filepath are required")
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Mandatory fields are not present. licensekey, filepath are required"})
+	if licenseKey == "" || fileID == "" {
+		abortWithError(c, ErrMissingFields.WithDetails(gin.H{"fields": []string{"licensekey", "fileid"}}))
+		return
+	}
 
+	// Validate the license
+	tenant := callerTenant(c)
+	license, err := s.ValidateLicenseKey(tenant, licenseKey, OP_DECRYPT)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	key := license.Key
+	if err := license.AllowsOperation(OP_SHARE_LINK); err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	if key, err = uuid.Parse(licenseKey); err != nil {
-		LOG.Error("Couldn't parse license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Couldn't parse license key.", "error": err.Error()})
+	// Links can only be created for files the license has access to
+	if _, _, err := s.licensedFile(tenant, fileID, license); err != nil {
+		abortWithError(c, err)
+		return
+	}
 
+	if reqBody.MaxDownloads < 0 {
+		abortWithError(c, ErrInvalidMaxDownloads.WithDetails(gin.H{"maxDownloads": reqBody.MaxDownloads}))
+		return
 	}
 
-	// Validate the license
-	if _, err := ValidateLicenseKey(key); err != nil {
+	linkID, token, err := s.NewLinkToken()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	now := s.Clock.Now()
+	link := LinkRecord{
+		ID:           linkID,
+		FileID:       fileID,
+		LicenseKey:   key,
+		Tenant:       tenant,
+		CreatedBy:    requestedBy(c),
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(s.Config.LinkTTL.Duration),
+		MaxDownloads: reqBody.MaxDownloads,
+	}
+	if err := s.Links.PutLink(link); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("secure link generated successfully. Link id: ", linkID)
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "secure link generated successfully", "URL": s.SecureLinkURL(token), "link": link})
+
+}
+
+// @Summary List secure links
+// @Description Get the active (not expired, revoked or used up) secure links created with the license key.
+// @Produce json
+// @Param licensekey query string true "License key"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/links [get]
+func (s *Server) GetSecureLinks(c *gin.Context) {
+
+	key, err := s.ParseLicenseKey(c.Query("licensekey"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	license, err := s.Licenses.GetLicense(key)
+	if err == nil && license.Tenant != callerTenant(c) {
+		err = ErrLicenseNotFound
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	links, err := s.Links.ListLinks(key)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	now := s.Clock.Now()
+	active := []LinkRecord{}
+	for _, link := range links {
+		if CheckLink(link, now) == nil {
+			active = append(active, link)
+		}
+	}
+
+	s.Log.Info("Fetched secure links successfully")
+	c.IndentedJSON(http.StatusOK, active)
+
+}
+
+// @Summary Revoke a secure link
+// @Description Revoke the secure link immediately. The license and its other links stay valid.
+// @Produce json
+// @Param id path string true "Link id"
+// @Param licensekey query string true "License key the link was created with"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/links/{id} [delete]
+func (s *Server) RevokeSecureLink(c *gin.Context) {
 
-		LOG.Error("Invalid License key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusForbidden, gin.H{"message": err.Error()})
+	key, err := s.ParseLicenseKey(c.Query("licensekey"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
+	// Links of other licenses are reported as missing
+	link, err := s.Links.GetLink(c.Param("id"))
+	if err == nil && (link.LicenseKey != key || link.Tenant != callerTenant(c)) {
+		err = ErrLinkNotFound
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	expiry := time.Now().Add(time.Hour * 1).Unix()
-	URL := fmt.Sprintf("http://localhost:3000/sles/api/v1/secure-file?licensekey=%v&filepath=%v&expires=%d", licenseKey, filePath, expiry)
+	if link, err = s.Links.RevokeLink(link.ID, s.Clock.Now()); err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	LOG.Info("secure link generated successfully")
-	c.IndentedJSON(http.StatusCreated, gin.H{"message": "secure link generated successfully", "URL": URL})
+	s.Log.Info("Secure link revoked. Link id: ", link.ID)
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Link revoked", "link": link})
 
 }
 
@@ -209,132 +725,243 @@ func GenerateSecureURL(c *gin.Context) {
 // @Description File decryption using the specified license key
 // @Accept json
 // @Produce application/octet-stream
-// @Param filepath query string true "encrypted file path"
+// @Param fileid query string true "encrypted file id"
 // @Param licensekey query string true "license key for decryption"
+// @Param Range header string false "part of the file to decrypt, e.g. bytes=0-1023"
 // @Success 200 {file} file "Encrypted file"
+// @Success 206 {file} file "Part of the encrypted file"
 
-func DecryptFile(c *gin.Context) {
-	var err error
-	var key uuid.UUID
-	var licenseData License
-
+func (s *Server) DecryptFile(c *gin.Context) {
 	licenseKey := c.Query("licensekey")
-	filePath := c.Query("filepath")
-
-	if licenseKey == "" || filePath == "" {
-		LOG.Error("Mandatory fields are not present. licensekey, filepath are required")
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "licensekey, filepath are required"})
+	fileID := c.Query("fileid")
 
+	if licenseKey == "" || fileID == "" {
+		abortWithError(c, ErrMissingFields.WithDetails(gin.H{"fields": []string{"licensekey", "fileid"}}))
+		return
 	}
 
-	if key, err = uuid.Parse(licenseKey); err != nil {
-		LOG.Error("Couldn't parse license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Couldn't parse license key.", "error": err.Error()})
+	// Validate the license
+	tenant := callerTenant(c)
+	license, err := s.ValidateLicenseKey(tenant, licenseKey, OP_DECRYPT)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := license.AllowsOperation(OP_DECRYPT); err != nil {
+		abortWithError(c, err)
+		return
+	}
 
+	record, path, err := s.licensedFile(tenant, fileID, license)
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	// Validate the license
-	if licenseData, err = ValidateLicenseKey(key); err != nil {
-		LOG.Error("Invalid license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusForbidden, gin.H{"message": err.Error()})
+	s.serveDecryptedFile(c, license, record, path, nil)
 
-	}
+}
 
-	if File[filePath] != key {
-		LOG.Error("Invalid license key. The provided key cannot be used to decrypt this file. Error: ")
-		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Incorrect key"})
+// licensedFile returns the registered file if the license has access to it,
+// see License.AllowsFile. Missing files are answered like files with a wrong
+// key, so callers can't probe which ids exist.
+func (s *Server) licensedFile(tenant string, id string, license License) (FileRecord, string, error) {
 
+	record, path, err := s.ResolveFile(tenant, id)
+	if errors.Is(err, ErrFileNotFound) {
+		return record, "", ErrIncorrectKey
+	}
+	if err == nil {
+		err = license.AllowsFile(record)
 	}
+	return record, path, err
+}
 
-	FileName := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".dec"
-	decryptedFileName := filepath.Join(OUTPUTDIR, FileName)
+// serveDecryptedFile decrypts the registered file with the key of the license
+// it was encrypted with, spends a token of the caller's license and streams
+// the plaintext into the response. The plaintext is never written to disk.
+// A Range request is answered with the part asked for, only the frames
+// covering it are decrypted and only its bytes are charged. The caller has
+// already checked the license and its access to the file. use, if given, runs
+// once the rate limits allowed the download and is told whether the request
+// opens a new download or continues one.
+func (s *Server) serveDecryptedFile(c *gin.Context, license License, record FileRecord, path string, use func(opens bool) error) {
+
+	srcFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Registered, but the encrypted file is gone from the storage directory
+		abortWithError(c, ErrFileNotFound.Wrap(err))
+		return
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	defer srcFile.Close()
 
-	srcFile, err := os.Open(filepath.Join(OUTPUTDIR, filePath))
+	// Reads the header and unwraps the key, nothing is sent yet
+	encrypted, err := OpenEncryptedFile(s.Keys, record.LicenseKey, srcFile)
 	if err != nil {
-		LOG.Error("Unable to open the encrypted file. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "unable to open the encrypted file", "error": err.Error()})
+		abortWithError(c, err)
+		return
+	}
 
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = DetectContentType(record.DownloadName(), "")
+	}
+	if err := license.AllowsContent(encrypted.Size(), contentType); err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	// Create file to save encrypted data
-	destFile, err := os.Create(decryptedFileName)
+	// File ids are never reused, so the id is a strong validator of the plaintext
+	etag := strconv.Quote(record.ID)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", etag)
+	if !record.CreatedAt.IsZero() {
+		c.Header("Last-Modified", record.CreatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	part := byteRange{Start: 0, Length: encrypted.Size()}
+	requested, err := requestedRange(c.Request, encrypted.Size(), etag, record.CreatedAt)
 	if err != nil {
-		LOG.Error("Unable to create the decryption file. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "unable to create the decryption file", "error": err.Error()})
+		c.Header("Content-Range", "bytes */"+strconv.FormatInt(encrypted.Size(), 10))
+		abortWithError(c, err)
+		return
+	}
+	if requested != nil {
+		part = *requested
+	}
 
+	// A tampered file is refused before anything is charged or sent
+	if err := encrypted.Verify(part.Start, part.Length); err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	if err = AESDecryption(key, srcFile, destFile); err != nil {
-		LOG.Error("Error occurred while decrypting the file. Error:", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Error occurred while decrypting file", "error": err.Error()})
+	// A download costs a token when it starts at the beginning of the file.
+	// Clients fetch the rest in ranges, those continue a download of the file
+	// and only pay for their bytes.
+	opens := part.Start == 0 || !s.downloadedBefore(license, record.ID)
 
+	// Reserve the byte budget and spend the token before streaming, once the
+	// response starts it can't be turned into an error anymore. Consuming
+	// re-validates the license atomically.
+	meter, err := s.newLicenseMeter(license, part.Length)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if opens {
+		if _, err := s.ConsumeLicense(license.Key, OP_DECRYPT); err != nil {
+			meter.settle(false)
+			abortWithError(c, err)
+			return
+		}
 	}
 
-	// If it's usage bases, update the tokens
-	if licenseData.Type == USAGE_LIMITED {
-		licenseData.TokensLeft -= 1
-		Licenses[key] = licenseData
+	// Rate limits and link downloads can't be given back, so they are counted
+	// last. A request refused by them gets its bytes and token back.
+	err = s.acquireLicenseRate(c, license, OP_DECRYPT, part.Length)
+	if err == nil && use != nil {
+		err = use(opens)
+	}
+	if err != nil {
+		meter.settle(false)
+		if opens {
+			s.refundLicense(license.Key, OP_DECRYPT)
+		}
+		abortWithError(c, err)
+		return
+	}
+	encrypted.SetMeter(meter)
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.FormatInt(part.Length, 10))
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": record.DownloadName()}))
+	if requested != nil {
+		c.Header("Content-Range", part.ContentRange(encrypted.Size()))
+		c.Status(http.StatusPartialContent)
+	} else {
+		c.Status(http.StatusOK)
 	}
 
-	c.FileAttachment(decryptedFileName, FileName)
+	// The frames were verified above. A file changed since then fails
+	// authentication halfway and leaves the response shorter than its
+	// Content-Length, so clients see a broken download and not bad data.
+	// Whatever was streamed is charged.
+	_, err = encrypted.WriteRange(c.Writer, part.Start, part.Length)
+	s.recordUsage(c, license, OP_DECRYPT, record.ID, meter.settle(true), err == nil)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	defer srcFile.Close()
-	defer destFile.Close()
+	s.Log.Info("Decrypted file streamed successfully")
 
 }
 
 // @ignore
 // Summary Secure file access
-// @Description Validates the provided link. If the link is valid, it returns the decrypted file.
+// @Description Resolves the link token. If the link is valid, it returns the decrypted file.
 // @Accept json
-// @Param filepath query string true "encrypted file path"
-// @Param licensekey query string true "license key for decryption"
-// @Param expires query string true "Time of expiry"
-// @Success 302 {string} string "Redirecting to new URL"
-
-func SecureFileAccess(c *gin.Context) {
-	var key uuid.UUID
-	var err error
+// @Param token query string true "link token"
+// @Success 200 {file} file "Decrypted file"
 
-	licenseKey := c.Query("licensekey")
-	filePath := c.Query("filepath")
-	expires := c.Query("expires")
+func (s *Server) SecureFileAccess(c *gin.Context) {
 
-	if licenseKey == "" || filePath == "" || expires == "" {
-		LOG.Error("Mandatory fields are not present. licensekey, filepath, expires are required")
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Mandatory fields are not present. licensekey, filepath, expires are required"})
+	token := c.Query("token")
+	if token == "" {
+		abortWithError(c, ErrMissingFields.WithDetails(gin.H{"fields": []string{"token"}}))
+		return
+	}
 
+	// Forged tokens are rejected without touching the registry
+	linkID, ok := s.ParseLinkToken(token)
+	if !ok {
+		abortWithError(c, ErrInvalidLink)
+		return
 	}
 
-	// Check link expiry time
-	expirationTime, err := strconv.ParseInt(expires, 10, 64)
+	link, err := s.Links.GetLink(linkID)
 	if err != nil {
-		LOG.Error("Couldn't parse timestamp. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Couldn't parse timestamp.", "error": err.Error()})
-
+		abortWithError(c, ErrInvalidLink.Wrap(err))
+		return
 	}
 
-	if time.Now().Unix() > expirationTime {
-		LOG.Error("Link Expired.")
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "Link Expired. Please request new one."})
-
+	// Validate the license
+	license, err := s.ValidateLicenseKey(link.Tenant, link.LicenseKey.String(), OP_DECRYPT)
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	// validate licensekey -- it can be tampered. so check once
-	if key, err = uuid.Parse(licenseKey); err != nil {
-		LOG.Error("Couldn't parse license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Couldn't parse license key.", "error": err.Error()})
-
+	if err := license.AllowsOperation(OP_SHARE_LINK); err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	// Validate the license
-	if _, err := ValidateLicenseKey(key); err != nil {
-		LOG.Error("Invalid license key. Error: ", err.Error())
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-
+	record, path, err := s.ResolveFile(link.Tenant, link.FileID)
+	if err == nil && license.AllowsFile(record) != nil {
+		// Re-registered for another license since the link was created
+		err = ErrFileNotFound
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
 
-	redirectURL := fmt.Sprintf("http://localhost:3000/sles/api/v1/decrypt-file?licensekey=%v&filepath=%v", licenseKey, filePath)
-	c.Redirect(http.StatusFound, redirectURL)
+	s.Log.Info("Serving file through secure link ", linkID)
+	s.serveDecryptedFile(c, license, record, path, func(opens bool) error {
+		if !opens && link.Downloads > 0 {
+			// Continues a counted download, only revocation and expiry apply
+			link.MaxDownloads = 0
+			return CheckLink(link, s.Clock.Now())
+		}
+		// Counts the download, unless the link expired, was revoked or used up
+		_, err := s.Links.UseLink(linkID, s.Clock.Now())
+		return err
+	})
 
 }
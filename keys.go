@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+const MASTER_SECRET_ENV = "SLES_MASTER_SECRET"
+const MASTER_SECRET_FILE = "master.key"
+const MASTER_KEY_VERSION_FILE = "master-v%d.key"
+const MASTER_SECRET_SIZE = 32
+const DATA_KEY_SIZE = 32
+const KDF_SALT_SIZE = 16
+const KEK_INFO = "sles-kek-v1"
+
+var ErrKeyUnwrap = NewAPIError(http.StatusForbidden, "key_mismatch", "Unable to unwrap the file key")
+var ErrUnknownKeyVersion = NewAPIError(http.StatusUnprocessableEntity, "unknown_key_version", "The file key is wrapped under a master key version this server doesn't have")
+
+// LoadMasterSecret returns the server-side secret the signing keys and version
+// 1 of the local keyring are derived from. It never leaves the server, so
+// knowing a license key alone isn't enough to decrypt a file offline.
+//
+// The secret is read from (or created in) master.key inside dir. It's never
+// taken from the environment, which child processes and crash reports see.
+func LoadMasterSecret(dir string) ([]byte, error) {
+
+	// Ignoring a secret that used to be read from there would silently
+	// generate a new one
+	if _, found := os.LookupEnv(MASTER_SECRET_ENV); found {
+		return nil, fmt.Errorf("%s is no longer read, write the secret to %s in the keyring directory and unset it", MASTER_SECRET_ENV, MASTER_SECRET_FILE)
+	}
+
+	path := filepath.Join(dir, MASTER_SECRET_FILE)
+	secret, err := os.ReadFile(path)
+	if err == nil {
+		if len(secret) < MASTER_SECRET_SIZE {
+			return nil, fmt.Errorf("Master secret in %s is too short", path)
+		}
+		return secret, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// First start: generate a secret and keep it in the keyring
+	secret = make([]byte, MASTER_SECRET_SIZE)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, secret, 0600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// LocalKeyring is the file-based KeyManager. Version 1 is the master secret,
+// later versions are kept as master-v<N>.key in its directory. Versions added
+// there by security ops are picked up without a restart.
+type LocalKeyring struct {
+	mu      sync.RWMutex
+	dir     string
+	secrets map[uint32][]byte
+	current uint32
+}
+
+// NewLocalKeyring returns a keyring with secret as its only version. Versions
+// added by Rotate are stored in dir, or only kept in memory if dir is empty.
+func NewLocalKeyring(dir string, secret []byte) *LocalKeyring {
+	return &LocalKeyring{dir: dir, secrets: map[uint32][]byte{1: secret}, current: 1}
+}
+
+// LoadLocalKeyring returns the keyring with secret as version 1 and the later
+// versions found in dir.
+func LoadLocalKeyring(dir string, secret []byte) (*LocalKeyring, error) {
+
+	keys := NewLocalKeyring(dir, secret)
+	if err := keys.refresh(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// refresh loads the versions after the current one from the directory.
+func (k *LocalKeyring) refresh() error {
+
+	if k.dir == "" {
+		return nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for version := k.current + 1; ; version++ {
+		path := filepath.Join(k.dir, fmt.Sprintf(MASTER_KEY_VERSION_FILE, version))
+		secret, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(secret) < MASTER_SECRET_SIZE {
+			return fmt.Errorf("Master key in %s is too short", path)
+		}
+		k.secrets[version] = secret
+		k.current = version
+	}
+}
+
+// Rotate adds a random master key as the next version and makes it current.
+// Existing files keep their version until they are re-encrypted.
+func (k *LocalKeyring) Rotate() (uint32, error) {
+
+	if err := k.refresh(); err != nil {
+		return 0, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	secret := make([]byte, MASTER_SECRET_SIZE)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return 0, err
+	}
+
+	version := k.current + 1
+	if k.dir != "" {
+		// Never overwrite a key, files may still be wrapped under it
+		path := filepath.Join(k.dir, fmt.Sprintf(MASTER_KEY_VERSION_FILE, version))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return 0, err
+		}
+		_, err = file.Write(secret)
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return 0, err
+		}
+	}
+
+	k.secrets[version] = secret
+	k.current = version
+	return version, nil
+}
+
+func (k *LocalKeyring) Describe() (KeyInfo, error) {
+
+	if err := k.refresh(); err != nil {
+		return KeyInfo{}, err
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	info := KeyInfo{Backend: KEY_MANAGER_LOCAL, CurrentVersion: k.current}
+	for version := range k.secrets {
+		info.Versions = append(info.Versions, version)
+	}
+	slices.Sort(info.Versions)
+	return info, nil
+}
+
+// Wrap encrypts dataKey with a key-encryption key derived from the current
+// master key, a random salt and the license. The ciphertext is
+// salt || nonce || sealed key, the layout of the key block of version 2 and 3
+// containers.
+func (k *LocalKeyring) Wrap(license uuid.UUID, dataKey []byte, aad []byte) (WrappedKey, error) {
+
+	if err := k.refresh(); err != nil {
+		return WrappedKey{}, err
+	}
+	k.mu.RLock()
+	version := k.current
+	k.mu.RUnlock()
+
+	salt := make([]byte, KDF_SALT_SIZE)
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return WrappedKey{}, err
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return WrappedKey{}, err
+	}
+
+	aead, err := k.kek(version, license, salt)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+
+	ciphertext := append(salt, nonce...)
+	return WrappedKey{Version: version, Ciphertext: aead.Seal(ciphertext, nonce, dataKey, aad)}, nil
+}
+
+func (k *LocalKeyring) Unwrap(license uuid.UUID, wrapped WrappedKey, aad []byte) ([]byte, error) {
+
+	if len(wrapped.Ciphertext) < KDF_SALT_SIZE+gcmNonceSize {
+		return nil, ErrKeyUnwrap
+	}
+	salt := wrapped.Ciphertext[:KDF_SALT_SIZE]
+	nonce := wrapped.Ciphertext[KDF_SALT_SIZE : KDF_SALT_SIZE+gcmNonceSize]
+
+	aead, err := k.kek(wrapped.Version, license, salt)
+	if errors.Is(err, ErrUnknownKeyVersion) {
+		// The version may have been added since the last look
+		if err := k.refresh(); err != nil {
+			return nil, err
+		}
+		aead, err = k.kek(wrapped.Version, license, salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := aead.Open(nil, nonce, wrapped.Ciphertext[KDF_SALT_SIZE+gcmNonceSize:], aad)
+	if err != nil {
+		return nil, ErrKeyUnwrap
+	}
+	return dataKey, nil
+}
+
+// kek derives the key-encryption key of a file from the master key version,
+// the per-file salt and the license the file belongs to.
+func (k *LocalKeyring) kek(version uint32, license uuid.UUID, salt []byte) (cipher.AEAD, error) {
+
+	k.mu.RLock()
+	secret, found := k.secrets[version]
+	k.mu.RUnlock()
+	if !found {
+		return nil, ErrUnknownKeyVersion.WithDetails(map[string]uint32{"keyVersion": version})
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("Master secret is not configured")
+	}
+
+	info := append([]byte(KEK_INFO), license[:]...)
+	kek := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), kek); err != nil {
+		return nil, err
+	}
+	return newGCM(kek)
+}
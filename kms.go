@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const KEY_MANAGER_LOCAL = "local"
+const KEY_MANAGER_VAULT_TRANSIT = "vault-transit"
+const KEY_MANAGER_FAKE = "fake"
+
+const VAULT_TOKEN_ENV = "VAULT_TOKEN"
+
+var ErrKeyManagerUnavailable = NewAPIError(http.StatusServiceUnavailable, "key_manager_unavailable", "The key manager is unavailable. Please retry later")
+
+// WrappedKey is a data key encrypted under a version of the master key. The
+// ciphertext is stored in the file header as is, its layout is up to the key
+// manager.
+type WrappedKey struct {
+	Version    uint32
+	Ciphertext []byte
+}
+
+// KeyInfo describes a key manager to operators. It never carries key material.
+type KeyInfo struct {
+	Backend string `json:"backend"`
+	// Name of the master key in the backend, if it has one
+	Key            string   `json:"key,omitempty"`
+	CurrentVersion uint32   `json:"currentVersion"`
+	Versions       []uint32 `json:"versions"`
+	// Backend files are still unwrapped with while they are migrated
+	MigratingFrom string `json:"migratingFrom,omitempty"`
+}
+
+// KeyManager keeps the master keys the per-file data keys are wrapped under.
+// The service only ever sees wrapped data keys and the data keys themselves,
+// so the master keys can live in a KMS and be rotated there.
+type KeyManager interface {
+	// Wrap encrypts dataKey under the current master key version. The license
+	// and aad are bound to the result, unwrapping with others fails.
+	Wrap(license uuid.UUID, dataKey []byte, aad []byte) (WrappedKey, error)
+	// Unwrap returns the data key, ErrKeyUnwrap if the license or aad don't
+	// match and ErrUnknownKeyVersion if the master key version is gone.
+	Unwrap(license uuid.UUID, wrapped WrappedKey, aad []byte) ([]byte, error)
+	// Rotate adds a new master key version and makes it current.
+	Rotate() (uint32, error)
+	Describe() (KeyInfo, error)
+}
+
+// NewKeyManager returns the key manager selected by the configuration, one
+// that also unwraps with the previous key manager if one is configured. secret
+// is version 1 of the local keyring.
+func NewKeyManager(cfg Config, secret []byte) (KeyManager, error) {
+
+	keys, err := newKeyManager(cfg.KeyManager, cfg, secret)
+	if err != nil || cfg.PreviousKeyManager == "" {
+		return keys, err
+	}
+	previous, err := newKeyManager(cfg.PreviousKeyManager, cfg, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &MigratingKeyManager{Current: keys, Previous: previous, PreviousBackend: cfg.PreviousKeyManager}, nil
+}
+
+func newKeyManager(backend string, cfg Config, secret []byte) (KeyManager, error) {
+
+	switch backend {
+	case KEY_MANAGER_LOCAL:
+		return LoadLocalKeyring(cfg.KeyringDir, secret)
+
+	case KEY_MANAGER_VAULT_TRANSIT:
+		// The token never goes into the config file, only its location
+		token := os.Getenv(VAULT_TOKEN_ENV)
+		if cfg.VaultTokenFile != "" {
+			raw, err := os.ReadFile(cfg.VaultTokenFile)
+			if err != nil {
+				return nil, err
+			}
+			token = strings.TrimSpace(string(raw))
+		}
+		if token == "" {
+			return nil, fmt.Errorf("Vault transit needs a token in %s or the vaultTokenFile", VAULT_TOKEN_ENV)
+		}
+		return NewVaultTransit(cfg.VaultAddr, cfg.VaultTransitMount, cfg.VaultTransitKey, token), nil
+	}
+	return nil, fmt.Errorf("Unknown key manager %q", backend)
+}
+
+// MigratingKeyManager moves files from one key manager to another. New keys
+// are wrapped by Current, keys Current can't unwrap are tried with Previous,
+// so files keep working until a key rotation has re-wrapped them all.
+type MigratingKeyManager struct {
+	Current         KeyManager
+	Previous        KeyManager
+	PreviousBackend string
+}
+
+func (m *MigratingKeyManager) Wrap(license uuid.UUID, dataKey []byte, aad []byte) (WrappedKey, error) {
+	return m.Current.Wrap(license, dataKey, aad)
+}
+
+func (m *MigratingKeyManager) Unwrap(license uuid.UUID, wrapped WrappedKey, aad []byte) ([]byte, error) {
+
+	dataKey, err := m.Current.Unwrap(license, wrapped, aad)
+	// Only keys that aren't Current's are tried, an unavailable key manager
+	// is reported as is
+	if errors.Is(err, ErrKeyUnwrap) || errors.Is(err, ErrUnknownKeyVersion) {
+		return m.Previous.Unwrap(license, wrapped, aad)
+	}
+	return dataKey, err
+}
+
+func (m *MigratingKeyManager) Rotate() (uint32, error) {
+	return m.Current.Rotate()
+}
+
+func (m *MigratingKeyManager) Describe() (KeyInfo, error) {
+	info, err := m.Current.Describe()
+	info.MigratingFrom = m.PreviousBackend
+	return info, err
+}
+
+// FakeKeyManager is an in-process KeyManager for tests. It keeps random master
+// keys in memory, counts its calls and can be made to fail like an unreachable
+// KMS.
+type FakeKeyManager struct {
+	mu      sync.Mutex
+	keys    *LocalKeyring
+	err     error
+	wraps   int
+	unwraps int
+}
+
+func NewFakeKeyManager() *FakeKeyManager {
+	secret := make([]byte, MASTER_SECRET_SIZE)
+	rand.Read(secret)
+	return &FakeKeyManager{keys: NewLocalKeyring("", secret)}
+}
+
+// Fail makes every following call fail with err, or succeed again if err is nil.
+func (f *FakeKeyManager) Fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Calls returns how many keys were wrapped and unwrapped.
+func (f *FakeKeyManager) Calls() (wraps int, unwraps int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wraps, f.unwraps
+}
+
+func (f *FakeKeyManager) failure() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *FakeKeyManager) Wrap(license uuid.UUID, dataKey []byte, aad []byte) (WrappedKey, error) {
+	if err := f.failure(); err != nil {
+		return WrappedKey{}, err
+	}
+	f.mu.Lock()
+	f.wraps += 1
+	f.mu.Unlock()
+	return f.keys.Wrap(license, dataKey, aad)
+}
+
+func (f *FakeKeyManager) Unwrap(license uuid.UUID, wrapped WrappedKey, aad []byte) ([]byte, error) {
+	if err := f.failure(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.unwraps += 1
+	f.mu.Unlock()
+	return f.keys.Unwrap(license, wrapped, aad)
+}
+
+func (f *FakeKeyManager) Rotate() (uint32, error) {
+	if err := f.failure(); err != nil {
+		return 0, err
+	}
+	return f.keys.Rotate()
+}
+
+func (f *FakeKeyManager) Describe() (KeyInfo, error) {
+	if err := f.failure(); err != nil {
+		return KeyInfo{}, err
+	}
+	info, err := f.keys.Describe()
+	info.Backend = KEY_MANAGER_FAKE
+	return info, err
+}
+
+// currentKeyVersion returns the version new keys are wrapped under.
+func currentKeyVersion(keys KeyManager) (uint32, error) {
+	info, err := keys.Describe()
+	if err != nil {
+		return 0, err
+	}
+	if info.CurrentVersion == 0 {
+		return 0, errors.New("The key manager has no master key")
+	}
+	return info.CurrentVersion, nil
+}
+
+// @Summary Describe the key manager
+// @Description Get the key manager the master keys are kept in, the current master key version and the versions available. No key material is returned.
+// @Produce json
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/key-manager [get]
+func (s *Server) GetKeyManager(c *gin.Context) {
+
+	info, err := s.Keys.Describe()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, info)
+
+}
+
+// @Summary Rotate the master key
+// @Description Add a new master key version to the key manager. New files are wrapped under it, existing files keep their version until a key rotation re-encrypts them. The master keys are shared by all tenants.
+// @Produce json
+// @Success 201
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/key-manager/rotate [post]
+func (s *Server) RotateMasterKey(c *gin.Context) {
+
+	version, err := s.Keys.Rotate()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	info, err := s.Keys.Describe()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("Master key rotated to version ", version, " by ", requestedBy(c))
+	c.IndentedJSON(http.StatusCreated, info)
+
+}
@@ -0,0 +1,75 @@
+package licensetoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// KeySet holds the public keys tokens are verified with, by key id.
+type KeySet map[string]ed25519.PublicKey
+
+// NewKeySet returns a key set of the keys.
+func NewKeySet(keys ...ed25519.PublicKey) KeySet {
+	set := KeySet{}
+	for _, key := range keys {
+		set[KeyID(key)] = key
+	}
+	return set
+}
+
+// JWK is an Ed25519 public key in JSON Web Key (RFC 8037) form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWKS is the document the server publishes its public keys in.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the keys of the set as a JSON Web Key Set.
+func (s KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for id, key := range s {
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key),
+			KeyID:     id,
+			Algorithm: ALGORITHM,
+			Use:       "sig",
+		})
+	}
+	return jwks
+}
+
+// ParseKeySet reads the JSON Web Key Set published by the server, e.g. saved
+// by the client application or fetched when it's online.
+func ParseKeySet(raw []byte) (KeySet, error) {
+
+	var jwks JWKS
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		return nil, err
+	}
+
+	set := KeySet{}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" {
+			continue
+		}
+		key, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid public key %q", jwk.KeyID)
+		}
+		// The id is derived from the key, so a key can't claim another's id
+		set[KeyID(key)] = ed25519.PublicKey(key)
+	}
+	return set, nil
+}
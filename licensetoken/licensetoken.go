@@ -0,0 +1,179 @@
+// Package licensetoken issues and verifies signed license tokens. A token is
+// a compact JWS (RFC 7515) signed with Ed25519, carrying the terms of a
+// license as its claims. Client applications can embed this package to check
+// a license offline, with nothing but the public key of the issuing server.
+package licensetoken
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ALGORITHM is the JWS algorithm of Ed25519 signatures.
+const ALGORITHM = "EdDSA"
+
+const TOKEN_TYPE = "JWT"
+
+var ErrMalformed = errors.New("Malformed license token")
+var ErrUnknownKey = errors.New("License token is signed with an unknown key")
+var ErrSignature = errors.New("Invalid license token signature")
+var ErrExpired = errors.New("License token expired")
+var ErrNotYetValid = errors.New("License token is not valid yet")
+
+// Claims are the terms of a license. Times are seconds since the epoch, zero
+// for none. Limits that are absent are unlimited.
+type Claims struct {
+	// License key, the server knows the license by it
+	ID        string   `json:"jti"`
+	Issuer    string   `json:"iss,omitempty"`
+	Tenant    string   `json:"tenant"`
+	Type      string   `json:"type"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Expiry    int64    `json:"exp,omitempty"`
+	Limits    Limits   `json:"limits,omitempty"`
+	Features  []string `json:"features,omitempty"`
+	Scopes    *Scopes  `json:"scopes,omitempty"`
+}
+
+// Limits are the budgets of a license when the token was issued. The server
+// tracks what is left of them.
+type Limits struct {
+	Tokens        *int   `json:"tokens,omitempty"`
+	EncryptTokens *int   `json:"encryptTokens,omitempty"`
+	DecryptTokens *int   `json:"decryptTokens,omitempty"`
+	Bytes         *int64 `json:"bytes,omitempty"`
+}
+
+// Scopes restrict what a license can be used for. Tokens without scopes
+// allow everything.
+type Scopes struct {
+	// Out of "encrypt", "decrypt" and "share-link"
+	Operations  []string `json:"operations"`
+	MaxFileSize int64    `json:"maxFileSize,omitempty"`
+	MimeTypes   []string `json:"mimeTypes,omitempty"`
+	FileIDs     []string `json:"fileIds,omitempty"`
+}
+
+// Valid checks the validity period of the claims at the given time.
+func (c Claims) Valid(now time.Time) error {
+
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return ErrNotYetValid
+	}
+	if c.Expiry != 0 && now.Unix() >= c.Expiry {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Allows reports whether the license is scoped to the operation.
+func (c Claims) Allows(operation string) bool {
+	return c.Scopes == nil || slices.Contains(c.Scopes.Operations, operation)
+}
+
+// HasFeature reports whether the license enables the feature flag.
+func (c Claims) HasFeature(feature string) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// KeyID derives the id a public key is published under.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// Sign encodes the claims as a token signed with key.
+func Sign(claims Claims, key ed25519.PrivateKey) (string, error) {
+
+	rawHeader, err := json.Marshal(header{Algorithm: ALGORITHM, Type: TOKEN_TYPE, KeyID: KeyID(key.Public().(ed25519.PublicKey))})
+	if err != nil {
+		return "", err
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(rawClaims)
+	signature := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// LooksLikeToken reports whether s has the shape of a token, as opposed to a
+// bare license key. It doesn't check anything else.
+func LooksLikeToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// Parse checks the signature of the token against the keys and returns its
+// claims. The validity period isn't checked, see Verify.
+func Parse(token string, keys KeySet) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return claims, err
+	}
+	if h.Algorithm != ALGORITHM {
+		return claims, fmt.Errorf("%w: unsupported algorithm %q", ErrMalformed, h.Algorithm)
+	}
+	key, found := keys[h.KeyID]
+	if !found {
+		return claims, ErrUnknownKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrMalformed
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return claims, ErrSignature
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	return claims, nil
+}
+
+// Verify checks the signature of the token and that it's valid at the given
+// time, and returns its claims.
+func Verify(token string, keys KeySet, now time.Time) (Claims, error) {
+
+	claims, err := Parse(token, keys)
+	if err != nil {
+		return claims, err
+	}
+	return claims, claims.Valid(now)
+}
+
+func decodeSegment(segment string, v any) error {
+
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package licensetoken
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	keys := NewKeySet(public)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tokens := 5
+	claims := Claims{
+		ID:        "2c4b6d8e-0a1c-4e3f-9b5d-7f1a3c5e7b9d",
+		Tenant:    "acme",
+		Type:      "hybrid",
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.AddDate(0, 0, 30).Unix(),
+		Limits:    Limits{DecryptTokens: &tokens},
+		Features:  []string{"share-link"},
+		Scopes:    &Scopes{Operations: []string{"decrypt"}},
+	}
+	token, err := Sign(claims, private)
+	assert.NoError(t, err)
+	assert.True(t, LooksLikeToken(token))
+	assert.False(t, LooksLikeToken(claims.ID))
+
+	verified, err := Verify(token, keys, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, claims, verified)
+	assert.True(t, verified.HasFeature("share-link"))
+	assert.False(t, verified.HasFeature("decrypt"))
+	assert.True(t, verified.Allows("decrypt"))
+	assert.False(t, verified.Allows("encrypt"))
+	assert.True(t, Claims{}.Allows("encrypt"))
+
+	// The validity period is checked offline
+	_, err = Verify(token, keys, now.AddDate(0, 0, 31))
+	assert.ErrorIs(t, err, ErrExpired)
+	_, err = Verify(token, keys, now.Add(-time.Second))
+	assert.ErrorIs(t, err, ErrNotYetValid)
+
+	// Keys of other servers aren't trusted
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = Verify(token, NewKeySet(other), now)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestTamperedTokens(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	keys := NewKeySet(public)
+
+	token, _ := Sign(Claims{ID: "key", Type: "time-bound", Expiry: time.Now().Add(time.Hour).Unix()}, private)
+	parts := strings.Split(token, ".")
+
+	// Extending the expiry breaks the signature
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	claims := map[string]any{}
+	json.Unmarshal(raw, &claims)
+	claims["exp"] = time.Now().AddDate(10, 0, 0).Unix()
+	raw, _ = json.Marshal(claims)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(raw) + "." + parts[2]
+	_, err := Parse(tampered, keys)
+	assert.ErrorIs(t, err, ErrSignature)
+
+	// So does dropping the algorithm
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"` + KeyID(public) + `"}`))
+	_, err = Parse(none+"."+parts[1]+".", keys)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	for _, malformed := range []string{"", "a.b", "a.b.c", parts[0] + "." + parts[1] + ".!"} {
+		_, err = Parse(malformed, keys)
+		assert.ErrorIs(t, err, ErrMalformed, malformed)
+	}
+}
+
+func TestKeySetRoundTrip(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	raw, err := json.Marshal(NewKeySet(public).JWKS())
+	assert.NoError(t, err)
+	keys, err := ParseKeySet(raw)
+	assert.NoError(t, err)
+
+	token, _ := Sign(Claims{ID: "key"}, private)
+	_, err = Verify(token, keys, time.Now())
+	assert.NoError(t, err)
+
+	_, err = ParseKeySet([]byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","x":"short"}]}`))
+	assert.Error(t, err)
+}
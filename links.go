@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+const LINK_KEY_INFO = "sles-link-v1"
+const SECURE_FILE_PATH = "/sles/api/v1/secure-file"
+
+var ErrLinkNotFound = NewAPIError(http.StatusNotFound, "link_not_found", "Link doesn't exist")
+var ErrInvalidLink = NewAPIError(http.StatusUnauthorized, "invalid_link", "Invalid link.")
+var ErrLinkExpired = NewAPIError(http.StatusUnauthorized, "link_expired", "Link Expired. Please request new one.")
+var ErrLinkRevoked = NewAPIError(http.StatusGone, "link_revoked", "Link has been revoked")
+var ErrLinkExhausted = NewAPIError(http.StatusGone, "link_exhausted", "Link download limit reached")
+
+// LinkRecord is the server side state of a secure link. The link itself only
+// carries an opaque token naming the record.
+type LinkRecord struct {
+	ID           string     `json:"id"`
+	FileID       string     `json:"fileId"`
+	LicenseKey   uuid.UUID  `json:"licenseKey"`
+	Tenant       string     `json:"tenant"`
+	CreatedBy    string     `json:"createdBy"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	RevokedAt    *time.Time `json:"revokedAt,omitempty"`
+}
+
+// CheckLink reports whether the link can be used at the given time.
+func CheckLink(link LinkRecord, now time.Time) error {
+
+	if link.RevokedAt != nil {
+		return ErrLinkRevoked
+	}
+	if expired(link.ExpiresAt, now) {
+		return ErrLinkExpired
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return ErrLinkExhausted
+	}
+	return nil
+}
+
+// deriveLinkSigningKey derives the HMAC key for link tokens from the master
+// secret, so it's separate from the keys used for file encryption.
+func deriveLinkSigningKey(secret []byte) ([]byte, error) {
+
+	if len(secret) == 0 {
+		return nil, errors.New("Master secret is not configured")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(LINK_KEY_INFO)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *Server) linkSignature(linkID string) []byte {
+	mac := hmac.New(sha256.New, s.LinkSigningKey)
+	mac.Write([]byte(linkID))
+	return mac.Sum(nil)
+}
+
+// NewLinkToken returns a random link id and the token handed out for it. The
+// token is the id followed by its HMAC, so forged tokens are rejected before
+// the registry is consulted.
+func (s *Server) NewLinkToken() (string, string, error) {
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", "", err
+	}
+	linkID := base64.RawURLEncoding.EncodeToString(id)
+
+	signature := s.linkSignature(linkID)
+	return linkID, linkID + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ParseLinkToken verifies the token signature in constant time and returns the
+// link id.
+func (s *Server) ParseLinkToken(token string) (string, bool) {
+
+	linkID, encoded, found := strings.Cut(token, ".")
+	if !found || linkID == "" {
+		return "", false
+	}
+
+	provided, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	if !hmac.Equal(s.linkSignature(linkID), provided) {
+		return "", false
+	}
+	return linkID, true
+}
+
+// SecureLinkURL returns the shareable URL for a link token, below the public
+// base URL of the service.
+func (s *Server) SecureLinkURL(token string) string {
+	return s.Config.PublicURL(SECURE_FILE_PATH) + "?token=" + token
+}
@@ -1,42 +1,94 @@
 package main
 
 import (
-	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"path/filepath"
 
-	_ "license-encryption-service/docs"
+	"github.com/sirupsen/logrus"
 
-	swaggerFiles "github.com/swaggo/files"
-	ginSwagger "github.com/swaggo/gin-swagger"
+	"license-encryption-service/docs"
 )
 
-var Licenses = make(map[uuid.UUID]License)
-var File = make(map[string]uuid.UUID)
-var LOG logrus.Logger
-
 // @title Secure License Encryption Service
 // @version 1.0
 // @description Handles license generation, file encryption, and secure link creation.
 // @host localhost:3000
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
 func main() {
 
-	LOG = *GetLogger()
+	log := GetLogger()
+
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid configuration. Error: ", err.Error())
+	}
+
+	level, _ := logrus.ParseLevel(cfg.LogLevel)
+	log.SetLevel(level)
+
+	if err := os.MkdirAll(cfg.StorageDir, 0700); err != nil {
+		log.Fatal("Unable to create the output directory. Error: ", err.Error())
+	}
+
+	store, err := OpenBoltStore(filepath.Join(cfg.StorageDir, DB_FILE))
+	if err != nil {
+		log.Fatal("Unable to open the database. Error: ", err.Error())
+	}
+	defer store.Close()
+
+	// Earlier versions kept the master keys next to the encrypted files. A new
+	// secret would leave those files undecryptable, so they have to be moved.
+	if _, err := os.Stat(filepath.Join(cfg.StorageDir, MASTER_SECRET_FILE)); err == nil {
+		log.Fatal("Found ", MASTER_SECRET_FILE, " in the storage directory. Move it and the master-v<N>.key files to the keyring directory ", cfg.KeyringDir)
+	}
+
+	secret, err := LoadMasterSecret(cfg.KeyringDir)
+	if err != nil {
+		log.Fatal("Unable to load the master secret. Error: ", err.Error())
+	}
+
+	keys, err := NewKeyManager(cfg, secret)
+	if err != nil {
+		log.Fatal("Unable to set up the key manager. Error: ", err.Error())
+	}
+	info, err := keys.Describe()
+	if err != nil {
+		log.Fatal("Unable to reach the key manager. Error: ", err.Error())
+	}
+	log.Infof("Wrapping file keys with %s master key version %d", info.Backend, info.CurrentVersion)
+
+	server, err := NewServer(cfg, store, keys, secret, log)
+	if err != nil {
+		log.Fatal("Unable to set up the server. Error: ", err.Error())
+	}
+	if err := server.ResumeRotations(); err != nil {
+		log.Error("Unable to resume key rotations. Error: ", err.Error())
+	}
+
+	// Swagger UI should call the service the way clients reach it
+	if base, err := url.Parse(cfg.BaseURL); err == nil {
+		docs.SwaggerInfo.Host = base.Host
+		docs.SwaggerInfo.Schemes = []string{base.Scheme}
+	}
 
-	// routes
-	router := gin.Default()
-	router.GET("/sles/api/v1/fetch-license", GetLicense)
-	router.POST("/sles/api/v1/generate-license", GenerateLicense)
-	router.POST("/sles/api/v1/encrypt-file", EncryptFile)
-	router.GET("/sles/api/v1/encrypt-file", GetEncryptedFiles)
-	router.GET("/sles/api/v1/decrypt-file", DecryptFile)
-	router.POST("/sles/api/v1/generate-link", GenerateSecureURL)
-	router.GET("/sles/api/v1/secure-file", SecureFileAccess)
-	// swagger
-	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	if len(cfg.Credentials) == 0 {
+		log.Warn("No credentials configured, only secure links can be used")
+	}
+	router := server.Router()
 
 	// Start server
-	LOG.Info("Listening and serving on 3000")
-	router.Run("localhost:3000")
+	if cfg.TLSEnabled() {
+		log.Info("Listening and serving HTTPS on ", cfg.ListenAddr)
+		err = router.RunTLS(cfg.ListenAddr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		log.Info("Listening and serving HTTP on ", cfg.ListenAddr)
+		err = router.Run(cfg.ListenAddr)
+	}
+	if err != nil {
+		log.Error("Server stopped. Error: ", err.Error())
+	}
 
 }
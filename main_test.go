@@ -2,29 +2,130 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	_ "time/tzdata"
+
+	"license-encryption-service/licensetoken"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
-func setupRouter() *gin.Engine {
+// testKeys wraps the keys of files encrypted outside of a server
+var testKeys KeyManager
+
+func TestMain(m *testing.M) {
+	testKeys = NewFakeKeyManager()
+
+	// Tests work in temporary directories, the storage directory of the
+	// checkout must look the same afterwards so repeated runs start clean
+	storageDir := DefaultConfig().StorageDir
+	before := storageListing(storageDir)
+	code := m.Run()
+	if after := storageListing(storageDir); code == 0 && !slices.Equal(before, after) {
+		fmt.Fprintf(os.Stderr, "Tests changed %s: %v, was %v\n", storageDir, after, before)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// storageListing returns the names and sizes of the files below dir.
+func storageListing(dir string) []string {
+	var listing []string
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			info, _ := entry.Info()
+			listing = append(listing, fmt.Sprintf("%s:%d", path, info.Size()))
+		}
+		return nil
+	})
+	return listing
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestServer returns a server with an in-memory store, its own storage
+// directory, keyring and a fake clock, so tests don't share any state.
+func newTestServer(t *testing.T) *Server {
+	return newTestServerWithStore(t, NewMemoryStore())
+}
+
+func newTestServerWithStore(t *testing.T, store Store) *Server {
+	cfg := DefaultConfig()
+	cfg.StorageDir = t.TempDir()
+	cfg.Credentials = testCredentials
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	s, err := NewServer(cfg, store, NewFakeKeyManager(), newMasterSecret(), log)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err.Error())
+	}
+	s.Clock = &fakeClock{now: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	return s
+}
+
+// newMasterSecret returns a random master secret, every server gets its own.
+func newMasterSecret() []byte {
+	secret := make([]byte, MASTER_SECRET_SIZE)
+	rand.Read(secret)
+	return secret
+}
+
+func setupRouter(s *Server) *gin.Engine {
 	r := gin.Default()
+	r.Use(ErrorHandler(s.Log))
 	return r
 }
 
 // Handle failure cases
 
 func TestGenerateTimeBoundLicense(t *testing.T) {
-	r := setupRouter()
-	r.POST("/generate-license", GenerateLicense)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
 
 	license := LicenseRequest{
 		Type:   "time-bound",
@@ -42,12 +143,13 @@ func TestGenerateTimeBoundLicense(t *testing.T) {
 
 	assert.NotEmpty(t, resp.Key)
 	assert.Equal(t, "time-bound", resp.Type)
-	assert.Equal(t, time.Now().AddDate(0, 0, 7).Day(), resp.ExpiryDate.Day())
+	assert.Equal(t, s.Clock.Now().AddDate(0, 0, 7), resp.ExpiryDate)
 
 }
 func TestGenerateUsageLimitedLicense(t *testing.T) {
-	r := setupRouter()
-	r.POST("/generate-license", GenerateLicense)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
 
 	license := LicenseRequest{
 		Type:   "usage-limited",
@@ -65,13 +167,14 @@ func TestGenerateUsageLimitedLicense(t *testing.T) {
 
 	assert.NotEmpty(t, resp.Key)
 	assert.Equal(t, "usage-limited", resp.Type)
-	assert.Equal(t, 10, resp.TokensLeft)
+	assert.Equal(t, budget(10), resp.TokensLeft)
 
 }
 
 func TestInvalidLicenseType(t *testing.T) {
-	r := setupRouter()
-	r.POST("/generate-license", GenerateLicense)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
 
 	license := LicenseRequest{
 		Type:   "time",
@@ -87,8 +190,9 @@ func TestInvalidLicenseType(t *testing.T) {
 }
 
 func TestInvalidLicenseExpiry(t *testing.T) {
-	r := setupRouter()
-	r.POST("/generate-license", GenerateLicense)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
 
 	license := LicenseRequest{
 		Type:   "usage-limited",
@@ -104,8 +208,9 @@ func TestInvalidLicenseExpiry(t *testing.T) {
 }
 
 func TestFetchLicense(t *testing.T) {
-	r := setupRouter()
-	r.GET("/fetch-license", GetLicense)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.GET("/fetch-license", s.GetLicense)
 
 	req, _ := http.NewRequest("GET", "/fetch-license", nil)
 	w := httptest.NewRecorder()
@@ -117,10 +222,11 @@ func TestFetchLicense(t *testing.T) {
 
 func TestEncryptDecryption(t *testing.T) {
 
-	r := setupRouter()
-	r.POST("/generate-license", GenerateLicense)
-	r.POST("/encrypt-file", EncryptFile)
-	r.GET("/decrypt-file", DecryptFile)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
 
 	// GENERATE LICENSE
 	license := LicenseRequest{
@@ -162,9 +268,12 @@ func TestEncryptDecryption(t *testing.T) {
 	r.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+	assert.NoError(t, uuid.Validate(fileID))
+	assert.Equal(t, `attachment; filename="testfile.enc"`, w.Header().Get("Content-Disposition"))
 
-	// DECRYPTION - /decrypt-file?licensekey=1b8f08f7-09c8-408a-8a3f-ac54255b31a5&filepath=fileInput.enc
-	baseURL := fmt.Sprintf("/decrypt-file?licensekey=%v&filepath=%v", resp.Key, "testfile.enc")
+	// DECRYPTION - /decrypt-file?licensekey=1b8f08f7-09c8-408a-8a3f-ac54255b31a5&fileid=2c4b6d8e-0a1c-4e3f-9b5d-7f1a3c5e7b9d
+	baseURL := fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", resp.Key, fileID)
 
 	req, _ = http.NewRequest("GET", baseURL, nil)
 	w = httptest.NewRecorder()
@@ -172,13 +281,42 @@ func TestEncryptDecryption(t *testing.T) {
 	r.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, content, w.Body.Bytes())
 
+	// Streamed straight into the response, with the original file's metadata
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Content-Length"))
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, `attachment; filename=testfile.txt`, w.Header().Get("Content-Disposition"))
+	_, err = os.Stat(filepath.Join(s.Blobs.TenantDir(DEFAULT_TENANT), "testfile.dec"))
+	assert.True(t, os.IsNotExist(err))
+
+}
+
+func TestRoundTripSizes(t *testing.T) {
+	key := uuid.New()
+	sizes := []int{0, 1, 15, 16, 17, 1000, CHUNK_SIZE - 1, CHUNK_SIZE, CHUNK_SIZE + 1, 3 * CHUNK_SIZE, 3*CHUNK_SIZE + 7}
+
+	for _, size := range sizes {
+		content := make([]byte, size)
+		rand.Read(content)
+		// Trailing zeros must survive the round trip as well
+		if size > 2 {
+			content[size-1], content[size-2] = 0, 0
+		}
+
+		decrypted, err := decryptFromPath(key, encryptToTemp(t, key, content))
+		assert.NoError(t, err, "size %d", size)
+		assert.Equal(t, size, len(decrypted), "size %d", size)
+		assert.True(t, bytes.Equal(content, decrypted), "size %d", size)
+	}
 }
 
 func TestGenerateLink(t *testing.T) {
-	r := setupRouter()
-	r.POST("/generate-license", GenerateLicense)
-	r.POST("/generate-link", GenerateSecureURL)
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
 
 	// GENERATE LICENSE
 	license := LicenseRequest{
@@ -195,8 +333,13 @@ func TestGenerateLink(t *testing.T) {
 	resp := License{}
 	json.Unmarshal(responseData, &resp)
 
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(resp.Key.String(), "testfile.txt", []byte("Hello world")))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
 	// Generate secure shareable URL
-	reqBody := URLRequest{LicenseKey: resp.Key.String(), FilePath: "testfile.enc"}
+	reqBody := URLRequest{LicenseKey: resp.Key.String(), FileID: fileID}
 	jsonBody, _ = json.Marshal(reqBody)
 	fmt.Print(string(jsonBody))
 
@@ -206,4 +349,2784 @@ func TestGenerateLink(t *testing.T) {
 	r.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// A different license can't share the file
+	other := newLicense(t, r, USAGE_LIMITED, 6)
+	jsonBody, _ = json.Marshal(URLRequest{LicenseKey: other.Key.String(), FileID: fileID})
+	req, _ = http.NewRequest("POST", "/generate-link", bytes.NewBuffer(jsonBody))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
+
+func TestSecureLinkRegistry(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
+	r.GET("/links", s.GetSecureLinks)
+	r.DELETE("/links/:id", s.RevokeSecureLink)
+	r.GET("/secure-file", s.SecureFileAccess)
+
+	license := newLicense(t, r, TIME_BOUND, 7)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "linked.txt", []byte("shared content")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	generate := func(maxDownloads int) (string, LinkRecord) {
+		jsonBody, _ := json.Marshal(URLRequest{LicenseKey: license.Key.String(), FileID: fileID, MaxDownloads: maxDownloads})
+		req, _ := http.NewRequest("POST", "/generate-link", bytes.NewBuffer(jsonBody))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var resp struct {
+			URL  string
+			Link LinkRecord
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		link, _ := url.Parse(resp.URL)
+		return link.Query().Get("token"), resp.Link
+	}
+	get := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/secure-file?token="+url.QueryEscape(token), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	token, link := generate(2)
+	assert.NotContains(t, token, license.Key.String())
+	assert.NotContains(t, token, "linked")
+
+	// Download limit
+	w = get(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "shared content", w.Body.String())
+	assert.Equal(t, http.StatusOK, get(token).Code)
+	assert.Equal(t, http.StatusGone, get(token).Code)
+
+	// Ranges continue a counted download, even of a used up link, only
+	// starting over counts as a new download
+	req, _ := http.NewRequest("GET", "/secure-file?token="+url.QueryEscape(token), nil)
+	req.Header.Set("Range", "bytes=7-")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "content", w.Body.String())
+	req.Header.Set("Range", "bytes=0-5")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	// Forged and unknown tokens
+	assert.Equal(t, http.StatusUnauthorized, get(link.ID+".AAAA").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("garbage").Code)
+
+	// Revocation only affects the revoked link
+	leaked, leakedLink := generate(0)
+	other, _ := generate(0)
+
+	req, _ = http.NewRequest("GET", "/links?licensekey="+license.Key.String(), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var active []LinkRecord
+	json.Unmarshal(w.Body.Bytes(), &active)
+	assert.Len(t, active, 2)
+
+	req, _ = http.NewRequest("DELETE", "/links/"+leakedLink.ID+"?licensekey="+uuid.NewString(), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req, _ = http.NewRequest("DELETE", "/links/"+leakedLink.ID+"?licensekey="+license.Key.String(), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusGone, get(leaked).Code)
+	assert.Equal(t, http.StatusOK, get(other).Code)
+
+	// Links expire once their TTL passed
+	s.Clock.(*fakeClock).Advance(s.Config.LinkTTL.Duration + time.Second)
+	assert.Equal(t, http.StatusUnauthorized, get(other).Code)
+}
+
+// encryptToTemp encrypts content with key and returns the path of the container
+func encryptToTemp(t *testing.T, key uuid.UUID, content []byte) string {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "plain")
+	if err := os.WriteFile(srcPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	src, _ := os.Open(srcPath)
+	defer src.Close()
+
+	encPath := filepath.Join(dir, "plain.enc")
+	dest, _ := os.Create(encPath)
+	defer dest.Close()
+
+	if _, err := AESEncryption(testKeys, key, src, dest, nil); err != nil {
+		t.Fatalf("Encryption failed: %s", err.Error())
+	}
+	return encPath
+}
+
+func decryptFromPath(key uuid.UUID, encPath string) ([]byte, error) {
+	src, err := os.Open(encPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	decPath := encPath + ".dec"
+	dest, err := os.Create(decPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+
+	if err := AESDecryption(testKeys, key, src, dest, nil); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(decPath)
+}
+
+func TestTamperedFileIsRejected(t *testing.T) {
+	key := uuid.New()
+	encPath := encryptToTemp(t, key, bytes.Repeat([]byte("secret"), 20000))
+
+	data, _ := os.ReadFile(encPath)
+
+	// Flip a bit in the last frame, the header and the size field
+	_, rawHeader, _ := readContainerHeader(bytes.NewReader(data[len(CONTAINER_MAGIC):]))
+	lengthEnd := fixedHeaderSize + keyVersionSize + wrappedKeyLenSize
+	for _, offset := range []int{len(data) - 1, 5, fixedHeaderSize - 1, fixedHeaderSize + keyVersionSize - 1, lengthEnd - 1, len(rawHeader) - 1} {
+		tampered := append([]byte{}, data...)
+		tampered[offset] ^= 0x01
+		os.WriteFile(encPath, tampered, 0600)
+
+		_, err := decryptFromPath(key, encPath)
+		assert.Error(t, err, "offset %d", offset)
+	}
+
+	// A tampered frame in the middle fails the file before any plaintext,
+	// including the intact frames before it, is written out
+	middle := encryptToTemp(t, key, bytes.Repeat([]byte("secret"), CHUNK_SIZE/2))
+	tampered, _ := os.ReadFile(middle)
+	tampered[len(tampered)/2] ^= 0x01
+	os.WriteFile(middle, tampered, 0600)
+	src, _ := os.Open(middle)
+	defer src.Close()
+	var out bytes.Buffer
+	err := AESDecryption(testKeys, key, src, &out, nil)
+	assert.ErrorIs(t, err, ErrCorruptedFile)
+	assert.Zero(t, out.Len())
+
+	// Truncated file
+	os.WriteFile(encPath, data[:len(data)-10], 0600)
+	_, err = decryptFromPath(key, encPath)
+	assert.ErrorIs(t, err, ErrCorruptedFile)
+
+	// Wrong key
+	os.WriteFile(encPath, data, 0600)
+	_, err = decryptFromPath(uuid.New(), encPath)
+	assert.ErrorIs(t, err, ErrKeyUnwrap)
+}
+
+func TestLegacyFileDecryption(t *testing.T) {
+	key := uuid.New()
+	plain := []byte("legacy file content, 32 bytes!!!")
+
+	// Build a file the way the old CBC encrypter did: iv || blocks
+	iv := bytes.Repeat([]byte{0x42}, aes.BlockSize)
+	block, _ := aes.NewCipher(deriveFileKey(key))
+	ciphertext := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plain)
+
+	encPath := filepath.Join(t.TempDir(), "legacy.enc")
+	os.WriteFile(encPath, append(iv, ciphertext...), 0600)
+
+	decrypted, err := decryptFromPath(key, encPath)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, decrypted)
+}
+
+func TestVersion1FileDecryption(t *testing.T) {
+	key := uuid.New()
+	plain := []byte("written before per-file data keys")
+
+	// Version 1 containers have no key block and use sha256(licenseKey)
+	header := containerHeader{Version: 1, Algorithm: ALG_AES256_GCM_CHUNKED, ChunkSize: CHUNK_SIZE, OriginalSize: uint64(len(plain))}
+	rawHeader := header.encode()
+	aead, _ := newGCM(deriveFileKey(key))
+	sealed := aead.Seal(nil, header.chunkNonce(0, true), plain, rawHeader)
+
+	encPath := filepath.Join(t.TempDir(), "v1.enc")
+	os.WriteFile(encPath, append(rawHeader, sealed...), 0600)
+
+	decrypted, err := decryptFromPath(key, encPath)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, decrypted)
+}
+
+func TestDataKeysArePerFile(t *testing.T) {
+	key := uuid.New()
+	first, _ := os.ReadFile(encryptToTemp(t, key, []byte("same content")))
+	second, _ := os.ReadFile(encryptToTemp(t, key, []byte("same content")))
+
+	// Same license, same plaintext: the wrapped keys and ciphertexts differ
+	firstHeader, firstRaw, _ := readContainerHeader(bytes.NewReader(first[len(CONTAINER_MAGIC):]))
+	secondHeader, secondRaw, _ := readContainerHeader(bytes.NewReader(second[len(CONTAINER_MAGIC):]))
+	assert.NotEqual(t, firstHeader.WrappedKey, secondHeader.WrappedKey)
+	assert.NotEqual(t, first[len(firstRaw):], second[len(secondRaw):])
+
+	// Without the master key the license key alone can't unwrap the data key
+	encPath := encryptToTemp(t, key, []byte("same content"))
+	saved := testKeys
+	testKeys = NewFakeKeyManager()
+	defer func() { testKeys = saved }()
+
+	_, err := decryptFromPath(key, encPath)
+	assert.ErrorIs(t, err, ErrKeyUnwrap)
+}
+
+// decryptContainer decrypts an encrypted file held in memory with keys.
+func decryptContainer(t *testing.T, keys KeyManager, key uuid.UUID, encrypted []byte) (string, error) {
+	encPath := filepath.Join(t.TempDir(), "file.enc")
+	os.WriteFile(encPath, encrypted, 0600)
+	src, _ := os.Open(encPath)
+	defer src.Close()
+
+	var decrypted bytes.Buffer
+	err := AESDecryption(keys, key, src, &decrypted, nil)
+	return decrypted.String(), err
+}
+
+func TestOldContainerVersionsDecryption(t *testing.T) {
+	key := uuid.New()
+	plain := []byte("written before pluggable key managers")
+	keys := NewLocalKeyring("", newMasterSecret())
+
+	// Version 2 and 3 containers have a fixed size key block in the layout of
+	// the local keyring, version 2 ones use the first master key
+	for _, version := range []uint8{2, 3} {
+		header := containerHeader{Version: version, Algorithm: ALG_AES256_GCM_CHUNKED, ChunkSize: CHUNK_SIZE, OriginalSize: uint64(len(plain))}
+		dataKey := bytes.Repeat([]byte{0x17}, DATA_KEY_SIZE)
+		wrapped, err := keys.Wrap(key, dataKey, header.encodeFixed())
+		assert.NoError(t, err)
+		assert.Len(t, wrapped.Ciphertext, keyBlockSize)
+		header.KeyVersion = wrapped.Version
+		header.WrappedKey = wrapped.Ciphertext
+		rawHeader := header.encode()
+		aead, _ := newGCM(dataKey)
+		sealed := aead.Seal(nil, header.chunkNonce(0, true), plain, rawHeader)
+
+		decrypted, err := decryptContainer(t, keys, key, append(rawHeader, sealed...))
+		assert.NoError(t, err, "version %d", version)
+		assert.Equal(t, string(plain), decrypted)
+	}
+}
+
+func TestLoadMasterSecret(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keyring")
+
+	// Generated on first start and read back afterwards
+	secret, err := LoadMasterSecret(dir)
+	assert.NoError(t, err)
+	assert.Len(t, secret, MASTER_SECRET_SIZE)
+	info, _ := os.Stat(filepath.Join(dir, MASTER_SECRET_FILE))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	again, err := LoadMasterSecret(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, again)
+
+	// The environment is refused rather than ignored
+	t.Setenv(MASTER_SECRET_ENV, base64.StdEncoding.EncodeToString(newMasterSecret()))
+	_, err = LoadMasterSecret(dir)
+	assert.ErrorContains(t, err, MASTER_SECRET_ENV)
+}
+
+func TestLocalKeyring(t *testing.T) {
+	dir := t.TempDir()
+	key := uuid.New()
+	secret := newMasterSecret()
+
+	keys, err := LoadLocalKeyring(dir, secret)
+	assert.NoError(t, err)
+	version, _ := currentKeyVersion(keys)
+	assert.Equal(t, uint32(1), version)
+
+	var before bytes.Buffer
+	version, err = encryptStream(keys, key, 6, strings.NewReader("before"), &before, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), version)
+
+	version, err = keys.Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+	assert.FileExists(t, filepath.Join(dir, "master-v2.key"))
+
+	// Rotated versions survive a restart, new files use the latest
+	keys, err = LoadLocalKeyring(dir, secret)
+	assert.NoError(t, err)
+	info, _ := keys.Describe()
+	assert.Equal(t, KeyInfo{Backend: KEY_MANAGER_LOCAL, CurrentVersion: 2, Versions: []uint32{1, 2}}, info)
+
+	var after bytes.Buffer
+	version, err = encryptStream(keys, key, 5, strings.NewReader("after"), &after, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+
+	for plain, encrypted := range map[string][]byte{"before": before.Bytes(), "after": after.Bytes()} {
+		decrypted, err := decryptContainer(t, keys, key, encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, decrypted)
+	}
+
+	// Without the version the file was wrapped under, it can't be read
+	_, err = decryptContainer(t, NewLocalKeyring("", secret), key, after.Bytes())
+	assert.ErrorIs(t, err, ErrUnknownKeyVersion)
+
+	// Versions dropped into the directory by operators are picked up live
+	other, _ := LoadLocalKeyring(t.TempDir(), secret)
+	other.Rotate()
+	other.Rotate()
+	var dropped bytes.Buffer
+	_, err = encryptStream(other, key, 7, strings.NewReader("dropped"), &dropped, nil)
+	assert.NoError(t, err)
+	for _, version := range []uint32{2, 3} {
+		raw, _ := os.ReadFile(filepath.Join(other.dir, fmt.Sprintf(MASTER_KEY_VERSION_FILE, version)))
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf(MASTER_KEY_VERSION_FILE, version)), raw, 0600)
+	}
+	decrypted, err := decryptContainer(t, keys, key, dropped.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "dropped", decrypted)
+	version, _ = currentKeyVersion(keys)
+	assert.Equal(t, uint32(3), version)
+}
+
+// fakeTransit serves the parts of the Vault transit API the service uses. It
+// wraps keys with a local keyring, the derivation context is the license.
+type fakeTransit struct {
+	keys    *LocalKeyring
+	derived bool
+	down    atomic.Bool
+}
+
+func newFakeTransit(t *testing.T) (*fakeTransit, *httptest.Server) {
+	transit := &fakeTransit{keys: NewLocalKeyring("", newMasterSecret()), derived: true}
+	srv := httptest.NewServer(transit)
+	t.Cleanup(srv.Close)
+	return transit, srv
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	respond := func(status int, data any, errs ...string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"data": data, "errors": errs})
+	}
+	if f.down.Load() {
+		respond(http.StatusServiceUnavailable, nil, "Vault is sealed")
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != "s.token" {
+		respond(http.StatusForbidden, nil, "permission denied")
+		return
+	}
+
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	license, _ := base64.StdEncoding.DecodeString(body["context"])
+	aad, _ := base64.StdEncoding.DecodeString(body["associated_data"])
+
+	switch r.Method + " " + r.URL.Path {
+	case "GET /v1/transit/keys/sles":
+		info, _ := f.keys.Describe()
+		versions := map[string]int{}
+		for _, version := range info.Versions {
+			versions[strconv.Itoa(int(version))] = 1
+		}
+		respond(http.StatusOK, map[string]any{"latest_version": info.CurrentVersion, "keys": versions, "derived": f.derived})
+
+	case "POST /v1/transit/keys/sles/rotate":
+		f.keys.secrets[f.keys.current+1] = bytes.Repeat([]byte{byte(f.keys.current)}, MASTER_SECRET_SIZE)
+		f.keys.current += 1
+		respond(http.StatusNoContent, nil)
+
+	case "POST /v1/transit/encrypt/sles":
+		plaintext, _ := base64.StdEncoding.DecodeString(body["plaintext"])
+		wrapped, _ := f.keys.Wrap(uuid.UUID(license), plaintext, aad)
+		respond(http.StatusOK, map[string]any{
+			"ciphertext":  fmt.Sprintf("vault:v%d:%s", wrapped.Version, base64.StdEncoding.EncodeToString(wrapped.Ciphertext)),
+			"key_version": wrapped.Version,
+		})
+
+	case "POST /v1/transit/decrypt/sles":
+		version, err := vaultCiphertextVersion(body["ciphertext"])
+		if err != nil {
+			respond(http.StatusBadRequest, nil, err.Error())
+			return
+		}
+		ciphertext, _ := base64.StdEncoding.DecodeString(strings.SplitN(body["ciphertext"], ":", 3)[2])
+		plaintext, err := f.keys.Unwrap(uuid.UUID(license), WrappedKey{Version: version, Ciphertext: ciphertext}, aad)
+		if err != nil {
+			respond(http.StatusBadRequest, nil, "cipher: message authentication failed")
+			return
+		}
+		respond(http.StatusOK, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+
+	default:
+		respond(http.StatusNotFound, nil)
+	}
+}
+
+func TestVaultTransit(t *testing.T) {
+	transit, srv := newFakeTransit(t)
+	keys := NewVaultTransit(srv.URL+"/", "transit", "sles", "s.token")
+	key := uuid.New()
+
+	info, err := keys.Describe()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyInfo{Backend: KEY_MANAGER_VAULT_TRANSIT, Key: "transit/sles", CurrentVersion: 1, Versions: []uint32{1}}, info)
+
+	var before bytes.Buffer
+	version, err := encryptStream(keys, key, 6, strings.NewReader("before"), &before, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), version)
+	header, _, _ := readContainerHeader(bytes.NewReader(before.Bytes()[len(CONTAINER_MAGIC):]))
+	assert.True(t, strings.HasPrefix(string(header.WrappedKey), "vault:v1:"))
+
+	version, err = keys.Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+
+	var after bytes.Buffer
+	version, err = encryptStream(keys, key, 5, strings.NewReader("after"), &after, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+
+	for plain, encrypted := range map[string][]byte{"before": before.Bytes(), "after": after.Bytes()} {
+		decrypted, err := decryptContainer(t, keys, key, encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, decrypted)
+	}
+
+	// The license and the header are bound to the wrapped key, and the
+	// version in the header has to match the ciphertext
+	_, err = decryptContainer(t, keys, uuid.New(), before.Bytes())
+	assert.ErrorIs(t, err, ErrKeyUnwrap)
+	_, err = keys.Unwrap(key, WrappedKey{Version: 2, Ciphertext: header.WrappedKey}, header.encodeFixed())
+	assert.ErrorIs(t, err, ErrKeyUnwrap)
+	_, err = keys.Unwrap(key, WrappedKey{Version: 1, Ciphertext: header.WrappedKey}, []byte("other header"))
+	assert.ErrorIs(t, err, ErrKeyUnwrap)
+
+	// Refused tokens, outages and unreachable servers are the KMS' problem
+	_, err = NewVaultTransit(srv.URL, "transit", "sles", "s.other").Describe()
+	assert.ErrorIs(t, err, ErrKeyManagerUnavailable)
+	transit.down.Store(true)
+	_, err = decryptContainer(t, keys, key, before.Bytes())
+	assert.ErrorIs(t, err, ErrKeyManagerUnavailable)
+	_, err = NewVaultTransit("http://127.0.0.1:1", "transit", "sles", "s.token").Describe()
+	assert.ErrorIs(t, err, ErrKeyManagerUnavailable)
+
+	// Nested mounts keep their separators
+	var requested string
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.EscapedPath()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer recorder.Close()
+	NewVaultTransit(recorder.URL, "/transit/prod eu/", "sles", "s.token").Describe()
+	assert.Equal(t, "/v1/transit/prod%20eu/keys/sles", requested)
+
+	// Keys without derivation would ignore the license
+	transit.down.Store(false)
+	transit.derived = false
+	_, err = keys.Describe()
+	assert.Error(t, err)
+}
+
+func TestKeyManagerOutage(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	keys := s.Keys.(*FakeKeyManager)
+
+	license := newLicense(t, r, "time-bound", 30)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", []byte("kept in the KMS")))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	keys.Fail(ErrKeyManagerUnavailable.Wrap(io.ErrUnexpectedEOF))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", []byte("not stored")))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), ErrKeyManagerUnavailable.Code)
+
+	decrypt := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil))
+		return w
+	}
+	w = decrypt()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), ErrKeyManagerUnavailable.Code)
+
+	keys.Fail(nil)
+	w = decrypt()
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "kept in the KMS", w.Body.String())
+	wraps, unwraps := keys.Calls()
+	assert.Equal(t, 1, wraps)
+	assert.Equal(t, 1, unwraps)
+
+	r.GET("/key-manager", s.GetKeyManager)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("GET", "/key-manager", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"backend": "fake", "currentVersion": 1, "versions": [1]}`, w.Body.String())
+}
+
+func TestBoltStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DB_FILE)
+
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err.Error())
+	}
+	license := License{Key: uuid.New(), Type: USAGE_LIMITED, TokensLeft: budget(3)}
+	assert.NoError(t, store.PutLicense(license))
+	assert.NoError(t, store.PutFile(FileRecord{ID: "report", Tenant: "acme", LicenseKey: license.Key}))
+	store.Close()
+
+	// Everything survives a restart
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %s", err.Error())
+	}
+	defer store.Close()
+
+	stored, err := store.GetLicense(license.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, license, stored)
+
+	record, err := store.GetFile("acme", "report")
+	assert.NoError(t, err)
+	assert.Equal(t, license.Key, record.LicenseKey)
+	_, err = store.GetFile(DEFAULT_TENANT, "report")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	assert.ErrorIs(t, store.DeleteFile(DEFAULT_TENANT, "report"), ErrFileNotFound)
+
+	_, err = store.GetLicense(uuid.New())
+	assert.ErrorIs(t, err, ErrLicenseNotFound)
+
+	// Links keep their download count and revocation
+	assert.NoError(t, store.PutLink(LinkRecord{ID: "link", LicenseKey: license.Key, ExpiresAt: time.Now().Add(time.Hour), MaxDownloads: 1}))
+	_, err = store.UseLink("link", time.Now())
+	assert.NoError(t, err)
+	_, err = store.UseLink("link", time.Now())
+	assert.ErrorIs(t, err, ErrLinkExhausted)
+	links, _ := store.ListLinks(license.Key)
+	assert.Len(t, links, 1)
+	assert.Equal(t, 1, links[0].Downloads)
+
+	// Licenses are listed in the same order as by the memory store
+	memory := NewMemoryStore()
+	for i := 0; i < 10; i++ {
+		tenantLicense := License{Key: uuid.New(), Type: PERPETUAL, Tenant: "acme"}
+		store.PutLicense(tenantLicense)
+		memory.PutLicense(tenantLicense)
+	}
+	listed, _ := store.ListLicenses("acme")
+	expected, _ := memory.ListLicenses("acme")
+	assert.Equal(t, expected, listed)
+
+	version, _ := store.SchemaVersion()
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestBoltStoreRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DB_FILE)
+
+	db, _ := bolt.Open(path, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists(metaBucket)
+		return meta.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, uint64(len(migrations)+1)))
+	})
+	db.Close()
+
+	_, err := OpenBoltStore(path)
+	assert.Error(t, err)
+}
+
+// newLicense generates a license through the handler
+func newLicense(t *testing.T, r *gin.Engine, licenseType string, expiry int) License {
+	jsonBody, _ := json.Marshal(LicenseRequest{Type: licenseType, Expiry: expiry})
+
+	req, _ := http.NewRequest("POST", "/generate-license", bytes.NewBuffer(jsonBody))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to generate license: %s", w.Body.String())
+	}
+	resp := License{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+// encryptRequest builds a multipart upload for /encrypt-file
+func encryptRequest(licenseKey string, fileName string, content []byte) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("licensekey", licenseKey)
+	part, _ := writer.CreateFormFile("file", fileName)
+	part.Write(content)
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/encrypt-file", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestConcurrentTokenAccounting(t *testing.T) {
+	boltStore, err := OpenBoltStore(filepath.Join(t.TempDir(), DB_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltStore.Close()
+
+	stores := map[string]Store{"memory": NewMemoryStore(), "bolt": boltStore}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServerWithStore(t, store)
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(ErrorHandler(s.Log))
+			r.POST("/generate-license", s.GenerateLicense)
+			r.POST("/encrypt-file", s.EncryptFile)
+			r.GET("/decrypt-file", s.DecryptFile)
+
+			const tokens = 5
+			const workers = 20
+			license := newLicense(t, r, USAGE_LIMITED, tokens)
+
+			var wg sync.WaitGroup
+			var succeeded atomic.Int32
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					fileName := fmt.Sprintf("concurrent-%s-%d.txt", name, i)
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, encryptRequest(license.Key.String(), fileName, []byte("payload")))
+					if w.Code == http.StatusOK {
+						succeeded.Add(1)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(tokens), succeeded.Load())
+			stored, _ := store.GetLicense(license.Key)
+			assert.Equal(t, budget(0), stored.TokensLeft)
+
+			// Same for decryption: one upload, then a burst of decrypts
+			license = newLicense(t, r, USAGE_LIMITED, tokens)
+			fileName := fmt.Sprintf("concurrent-%s.txt", name)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, encryptRequest(license.Key.String(), fileName, []byte("payload")))
+			assert.Equal(t, http.StatusOK, w.Code)
+			fileID := w.Header().Get(FILE_ID_HEADER)
+
+			succeeded.Store(0)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					url := fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID)
+					req, _ := http.NewRequest("GET", url, nil)
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, req)
+					if w.Code == http.StatusOK {
+						succeeded.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(tokens-1), succeeded.Load())
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configFile, []byte(`{"listenAddr": ":8080", "baseURL": "https://files.example.com", "linkTTL": "30m", "logLevel": "debug"}`), 0600)
+
+	// Defaults, except for the keyring which has to be given
+	_, err := LoadConfig(nil)
+	assert.ErrorContains(t, err, "Keyring directory is required")
+	t.Setenv("SLES_KEYRING_DIR", "/etc/sles/keyring")
+	cfg, err := LoadConfig(nil)
+	assert.NoError(t, err)
+	defaults := DefaultConfig()
+	defaults.KeyringDir = "/etc/sles/keyring"
+	assert.Equal(t, defaults, cfg)
+
+	// File, then env, then flags
+	t.Setenv(CONFIG_ENV, configFile)
+	t.Setenv("SLES_LISTEN_ADDR", ":9090")
+	t.Setenv("SLES_STORAGE_DIR", "/var/lib/sles")
+	cfg, err = LoadConfig([]string{"-listen", ":9443", "-tls-cert", "cert.pem", "-tls-key", "key.pem"})
+	assert.NoError(t, err)
+	assert.Equal(t, ":9443", cfg.ListenAddr)
+	assert.Equal(t, "https://files.example.com", cfg.BaseURL)
+	assert.Equal(t, "/var/lib/sles", cfg.StorageDir)
+	assert.Equal(t, 30*time.Minute, cfg.LinkTTL.Duration)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.True(t, cfg.TLSEnabled())
+	assert.Equal(t, "/etc/sles/keyring", cfg.KeyringDir)
+
+	// Generated links use the public base URL
+	s := &Server{Config: cfg}
+	assert.Equal(t, "https://files.example.com/sles/api/v1/secure-file?token=abc", s.SecureLinkURL("abc"))
+
+	// Invalid settings are rejected
+	for _, args := range [][]string{
+		{"-base-url", "files.example.com"},
+		{"-link-ttl", "soon"},
+		{"-link-ttl", "-1h"},
+		{"-log-level", "loud"},
+		{"-tls-cert", "cert.pem", "-tls-key", ""},
+		{"-key-manager", "hsm"},
+		{"-key-manager", "vault-transit"},
+		{"-key-manager", "vault-transit", "-vault-addr", "vault:8200"},
+		{"-key-manager", "vault-transit", "-vault-addr", "https://vault:8200", "-vault-transit-key", ""},
+		{"-previous-key-manager", "local"},
+		{"-previous-key-manager", "hsm"},
+		{"-previous-key-manager", "vault-transit"},
+		{"-keyring-dir", ""},
+		{"-keyring-dir", "/var/lib/sles"},
+		{"-keyring-dir", "/var/lib/sles/keys"},
+		{"-keyring-dir", "/etc/../var/lib/sles/keys"},
+	} {
+		_, err = LoadConfig(args)
+		assert.Error(t, err, "%v", args)
+	}
+
+	// Keyrings reached through a symlink into the storage directory are
+	// refused too
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "storage", "keys"), 0700)
+	os.Symlink(filepath.Join(dir, "storage", "keys"), filepath.Join(dir, "keyring"))
+	assert.True(t, within(filepath.Join(dir, "keyring"), filepath.Join(dir, "storage")))
+	assert.False(t, within(filepath.Join(dir, "storage-keys"), filepath.Join(dir, "storage")))
+
+	// Credentials need a name, a known role and distinct, long enough keys
+	cfg = DefaultConfig()
+	cfg.KeyringDir = "/etc/sles/keyring"
+	cfg.Credentials = []Credential{{Name: "ops", Key: "0123456789abcdef", Role: ROLE_ADMIN}}
+	assert.NoError(t, cfg.Validate())
+	for _, credential := range []Credential{
+		{Name: "", Key: "fedcba9876543210", Role: ROLE_ADMIN},
+		{Name: "app", Key: "fedcba9876543210", Role: "root"},
+		{Name: "app", Key: "short", Role: ROLE_CONSUMER},
+		{Name: "app", Key: "0123456789abcdef", Role: ROLE_CONSUMER},
+		{Name: "platform", Key: "fedcba9876543210", Role: ROLE_OPERATOR, Tenant: "acme"},
+	} {
+		invalid := cfg
+		invalid.Credentials = append([]Credential{}, cfg.Credentials...)
+		invalid.Credentials = append(invalid.Credentials, credential)
+		assert.Error(t, invalid.Validate(), "%+v", credential)
+	}
+}
+
+func jsonRequest(method string, path string, body any) *http.Request {
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+	return req
+}
+
+func TestHandlerFailures(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
+	r.GET("/links", s.GetSecureLinks)
+	r.DELETE("/links/:id", s.RevokeSecureLink)
+	r.GET(SECURE_FILE_PATH, s.SecureFileAccess)
+
+	owner := newLicense(t, r, USAGE_LIMITED, 10)
+	other := newLicense(t, r, USAGE_LIMITED, 10)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(owner.Key.String(), "failures.txt", []byte("Hello world")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	expired := License{Key: uuid.New(), Type: TIME_BOUND, ExpiryDate: s.Clock.Now().AddDate(0, 0, -1), Tenant: DEFAULT_TENANT}
+	used := License{Key: uuid.New(), Type: USAGE_LIMITED, TokensLeft: budget(0), Tenant: DEFAULT_TENANT}
+	s.Licenses.PutLicense(expired)
+	s.Licenses.PutLicense(used)
+
+	// A frame in the middle of the file was tampered with
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(owner.Key.String(), "tampered.bin", bytes.Repeat([]byte("secret"), CHUNK_SIZE/2)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	tamperedID := w.Header().Get(FILE_ID_HEADER)
+	_, tamperedPath, _ := s.ResolveFile(DEFAULT_TENANT, tamperedID)
+	tampered, _ := os.ReadFile(tamperedPath)
+	tampered[len(tampered)/2] ^= 0x01
+	os.WriteFile(tamperedPath, tampered, 0600)
+
+	// Registered for the owner, but gone from the storage directory
+	s.Files.PutFile(FileRecord{ID: "missing", Tenant: DEFAULT_TENANT, Path: tenantPath(DEFAULT_TENANT, "missing.enc"), LicenseKey: owner.Key, CreatedAt: s.Clock.Now()})
+	stored, _ := os.ReadDir(s.Blobs.TenantDir(DEFAULT_TENANT))
+
+	noFile := func() *http.Request {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		writer.WriteField("licensekey", owner.Key.String())
+		writer.Close()
+		req, _ := http.NewRequest("POST", "/encrypt-file", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+	decrypt := func(key string, file string) *http.Request {
+		req, _ := http.NewRequest("GET", "/decrypt-file?"+url.Values{"licensekey": {key}, "fileid": {file}}.Encode(), nil)
+		return req
+	}
+	get := func(path string) *http.Request {
+		req, _ := http.NewRequest("GET", path, nil)
+		return req
+	}
+	_, forged, _ := s.NewLinkToken()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		err    *APIError
+	}{
+		{"license malformed body", jsonRequest("POST", "/generate-license", "{"), http.StatusBadRequest, ErrInvalidRequest},
+		{"license missing fields", jsonRequest("POST", "/generate-license", LicenseRequest{}), http.StatusBadRequest, ErrMissingFields},
+		{"license bad type", jsonRequest("POST", "/generate-license", LicenseRequest{Type: "time", Expiry: 7}), http.StatusBadRequest, ErrUnsupportedLicenseType},
+		{"license bad expiry", jsonRequest("POST", "/generate-license", LicenseRequest{Type: TIME_BOUND, Expiry: -1}), http.StatusBadRequest, ErrInvalidExpiry},
+
+		{"encrypt missing file", noFile(), http.StatusBadRequest, ErrMissingFields},
+		{"encrypt missing key", encryptRequest("", "a.txt", []byte("a")), http.StatusBadRequest, ErrMissingFields},
+		{"encrypt bad uuid", encryptRequest("not-a-uuid", "a.txt", []byte("a")), http.StatusBadRequest, ErrInvalidLicenseKey},
+		{"encrypt unknown license", encryptRequest(uuid.NewString(), "a.txt", []byte("a")), http.StatusForbidden, ErrLicenseNotFound},
+		{"encrypt expired license", encryptRequest(expired.Key.String(), "a.txt", []byte("a")), http.StatusForbidden, ErrLicenseExpired},
+		{"encrypt used up license", encryptRequest(used.Key.String(), "a.txt", []byte("a")), http.StatusForbidden, ErrLicenseExpired},
+
+		{"decrypt missing fields", decrypt(owner.Key.String(), ""), http.StatusBadRequest, ErrMissingFields},
+		{"decrypt bad uuid", decrypt("not-a-uuid", fileID), http.StatusBadRequest, ErrInvalidLicenseKey},
+		{"decrypt expired license", decrypt(expired.Key.String(), fileID), http.StatusForbidden, ErrLicenseExpired},
+		{"decrypt wrong key", decrypt(other.Key.String(), fileID), http.StatusForbidden, ErrIncorrectKey},
+		{"decrypt unregistered file", decrypt(owner.Key.String(), uuid.NewString()), http.StatusForbidden, ErrIncorrectKey},
+		{"decrypt missing file", decrypt(owner.Key.String(), "missing"), http.StatusNotFound, ErrFileNotFound},
+		{"decrypt tampered file", decrypt(owner.Key.String(), tamperedID), http.StatusUnprocessableEntity, ErrCorruptedFile},
+
+		{"link missing fields", jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: owner.Key.String()}), http.StatusBadRequest, ErrMissingFields},
+		{"link bad uuid", jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: "not-a-uuid", FileID: fileID}), http.StatusBadRequest, ErrInvalidLicenseKey},
+		{"link expired license", jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: expired.Key.String(), FileID: fileID}), http.StatusForbidden, ErrLicenseExpired},
+		{"link wrong key", jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: other.Key.String(), FileID: fileID}), http.StatusForbidden, ErrIncorrectKey},
+		{"link bad max downloads", jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: owner.Key.String(), FileID: fileID, MaxDownloads: -1}), http.StatusBadRequest, ErrInvalidMaxDownloads},
+
+		{"list links bad uuid", get("/links?licensekey=nope"), http.StatusBadRequest, ErrInvalidLicenseKey},
+		{"list links unknown license", get("/links?licensekey=" + uuid.NewString()), http.StatusForbidden, ErrLicenseNotFound},
+		{"revoke unknown link", jsonRequest("DELETE", "/links/unknown?licensekey="+owner.Key.String(), nil), http.StatusNotFound, ErrLinkNotFound},
+
+		{"secure file missing token", get(SECURE_FILE_PATH), http.StatusBadRequest, ErrMissingFields},
+		{"secure file forged token", get(SECURE_FILE_PATH + "?token=abc.def"), http.StatusUnauthorized, ErrInvalidLink},
+		{"secure file unknown link", get(SECURE_FILE_PATH + "?token=" + forged), http.StatusUnauthorized, ErrInvalidLink},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, tc.req)
+
+			assert.Equal(t, tc.status, w.Code)
+			resp := APIError{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+			assert.Equal(t, tc.err.Code, resp.Code)
+			assert.NotEmpty(t, resp.Message)
+		})
+	}
+
+	// Failed requests must not spend tokens or leave files behind
+	license, _ := s.Licenses.GetLicense(owner.Key)
+	assert.Equal(t, budget(8), license.TokensLeft)
+	remaining, _ := os.ReadDir(s.Blobs.TenantDir(DEFAULT_TENANT))
+	assert.Equal(t, len(stored), len(remaining))
+}
+
+// failingFiles is a file registry whose writes fail.
+type failingFiles struct {
+	FileRegistry
+}
+
+func (failingFiles) PutFile(FileRecord) error {
+	return fmt.Errorf("write sles.db: no space left on device")
+}
+
+func TestEncryptFileRegistrationFailure(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: HYBRID, Tokens: 5, Bytes: CHUNK_SIZE}))
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+
+	s.Files = failingFiles{s.Files}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "unregistered.txt", []byte("Hello world")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), ErrInternal.Code)
+
+	// Nothing is charged and no blob is left without a registration
+	stored, _ := s.Licenses.GetLicense(license.Key)
+	assert.Equal(t, budget(5), stored.TokensLeft)
+	assert.Equal(t, budget(int64(CHUNK_SIZE)), stored.BytesLeft)
+	blobs, _ := os.ReadDir(s.Blobs.TenantDir(DEFAULT_TENANT))
+	assert.Empty(t, blobs)
+	usage, _ := s.Usage.ListUsage(license.Key)
+	assert.Empty(t, usage)
+}
+
+func TestErrorHandlerHidesInternalErrors(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.GET("/fail", func(c *gin.Context) {
+		abortWithError(c, fmt.Errorf("open /secret/path: permission denied"))
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/fail", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "/secret/path")
+	assert.Contains(t, w.Body.String(), ErrInternal.Code)
+}
+
+var testCredentials = []Credential{
+	{Name: "ops", Key: "admin-key-0123456789", Role: ROLE_ADMIN},
+	{Name: "billing", Key: "issuer-key-0123456789", Role: ROLE_ISSUER},
+	{Name: "consumer-app", Key: "consumer-key-0123456789", Role: ROLE_CONSUMER},
+	{Name: "platform", Key: "operator-key-0123456789", Role: ROLE_OPERATOR},
+}
+
+func TestRoleAuthorization(t *testing.T) {
+	s := newTestServer(t)
+	r := s.Router()
+
+	routes := []struct {
+		method  string
+		path    string
+		allowed []string
+	}{
+		{"GET", "/sles/api/v1/fetch-license", []string{ROLE_ADMIN}},
+		{"POST", "/sles/api/v1/generate-license", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"GET", "/sles/api/v1/licenses/unknown", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"PATCH", "/sles/api/v1/licenses/unknown", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"GET", "/sles/api/v1/licenses/unknown/usage", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"POST", "/sles/api/v1/licenses/unknown/suspend", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"POST", "/sles/api/v1/licenses/unknown/resume", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"POST", "/sles/api/v1/licenses/unknown/revoke", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"DELETE", "/sles/api/v1/licenses/unknown", []string{ROLE_ADMIN, ROLE_ISSUER}},
+		{"POST", "/sles/api/v1/encrypt-file", []string{ROLE_ADMIN, ROLE_CONSUMER}},
+		{"GET", "/sles/api/v1/encrypt-file", []string{ROLE_ADMIN}},
+		{"GET", "/sles/api/v1/decrypt-file", []string{ROLE_ADMIN, ROLE_CONSUMER}},
+		{"POST", "/sles/api/v1/generate-link", []string{ROLE_ADMIN, ROLE_CONSUMER}},
+		{"GET", "/sles/api/v1/links", []string{ROLE_ADMIN, ROLE_CONSUMER}},
+		{"DELETE", "/sles/api/v1/links/unknown", []string{ROLE_ADMIN, ROLE_CONSUMER}},
+		{"POST", "/sles/api/v1/key-rotations", []string{ROLE_ADMIN}},
+		{"GET", "/sles/api/v1/key-rotations", []string{ROLE_ADMIN}},
+		{"GET", "/sles/api/v1/key-rotations/unknown", []string{ROLE_ADMIN}},
+		{"POST", "/sles/api/v1/key-rotations/unknown/resume", []string{ROLE_ADMIN}},
+		{"GET", "/sles/api/v1/key-manager", []string{ROLE_ADMIN, ROLE_OPERATOR}},
+		{"POST", "/sles/api/v1/key-manager/rotate", []string{ROLE_OPERATOR}},
+	}
+
+	for _, route := range routes {
+		// No key or an unknown key never gets through
+		for _, key := range []string{"", "not-a-configured-key"} {
+			req, _ := http.NewRequest(route.method, route.path, nil)
+			if key != "" {
+				req.Header.Set(API_KEY_HEADER, key)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, "%s %s", route.method, route.path)
+		}
+
+		for _, credential := range testCredentials {
+			req, _ := http.NewRequest(route.method, route.path, nil)
+			req.Header.Set("Authorization", "Bearer "+credential.Key)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := APIError{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if slices.Contains(route.allowed, credential.Role) {
+				// The handler ran, whatever it made of the empty request
+				assert.NotEqual(t, ErrUnauthenticated.Code, resp.Code, "%s %s as %s", route.method, route.path, credential.Role)
+				assert.NotEqual(t, ErrForbidden.Code, resp.Code, "%s %s as %s", route.method, route.path, credential.Role)
+			} else {
+				assert.Equal(t, http.StatusForbidden, w.Code, "%s %s as %s", route.method, route.path, credential.Role)
+				assert.Equal(t, ErrForbidden.Code, resp.Code, "%s %s as %s", route.method, route.path, credential.Role)
+			}
+		}
+	}
+
+	// Secure links are authorized by their token alone
+	req, _ := http.NewRequest("GET", SECURE_FILE_PATH, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLinksRecordPrincipal(t *testing.T) {
+	s := newTestServer(t)
+	r := s.Router()
+	issuerKey, consumerKey := testCredentials[1].Key, testCredentials[2].Key
+
+	req := jsonRequest("POST", "/sles/api/v1/generate-license", LicenseRequest{Type: USAGE_LIMITED, Expiry: 5})
+	req.Header.Set(API_KEY_HEADER, issuerKey)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+
+	req = encryptRequest(license.Key.String(), "principal.txt", []byte("Hello world"))
+	req.URL.Path = "/sles/api/v1/encrypt-file"
+	req.Header.Set(API_KEY_HEADER, consumerKey)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = jsonRequest("POST", "/sles/api/v1/generate-link", URLRequest{LicenseKey: license.Key.String(), FileID: w.Header().Get(FILE_ID_HEADER)})
+	req.Header.Set(API_KEY_HEADER, consumerKey)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var resp struct {
+		Link LinkRecord `json:"link"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, "consumer-app", resp.Link.CreatedBy)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	credentials := []Credential{
+		{Name: "acme-ops", Key: "acme-admin-key-0123456789", Role: ROLE_ADMIN, Tenant: "acme"},
+		{Name: "acme-app", Key: "acme-consumer-key-0123456789", Role: ROLE_CONSUMER, Tenant: "acme"},
+		{Name: "globex-ops", Key: "globex-admin-key-0123456789", Role: ROLE_ADMIN, Tenant: "globex"},
+		{Name: "globex-app", Key: "globex-consumer-key-0123456789", Role: ROLE_CONSUMER, Tenant: "globex"},
+	}
+	s := newTestServer(t)
+	s.Config.Credentials = credentials
+	r := s.Router()
+
+	do := func(req *http.Request, apiKey string) *httptest.ResponseRecorder {
+		req.Header.Set(API_KEY_HEADER, apiKey)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	fileIDs := map[string]string{}
+	decrypt := func(license License, apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/sles/api/v1/decrypt-file?licensekey="+license.Key.String()+"&fileid="+fileIDs[license.Tenant], nil)
+		return do(req, apiKey)
+	}
+
+	// Both tenants upload a file with the same name
+	licenses := map[string]License{}
+	for _, tenant := range []string{"acme", "globex"} {
+		w := do(jsonRequest("POST", "/sles/api/v1/generate-license", LicenseRequest{Type: USAGE_LIMITED, Expiry: 5}), tenant+"-admin-key-0123456789")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		license := License{}
+		json.Unmarshal(w.Body.Bytes(), &license)
+		assert.Equal(t, tenant, license.Tenant)
+		licenses[tenant] = license
+
+		req := encryptRequest(license.Key.String(), "report.txt", []byte("report of "+tenant))
+		req.URL.Path = "/sles/api/v1/encrypt-file"
+		w = do(req, tenant+"-consumer-key-0123456789")
+		assert.Equal(t, http.StatusOK, w.Code)
+		fileIDs[tenant] = w.Header().Get(FILE_ID_HEADER)
+		_, err := os.Stat(filepath.Join(s.Blobs.TenantDir(tenant), fileIDs[tenant]+".enc"))
+		assert.NoError(t, err)
+	}
+
+	// Neither upload overwrote the other
+	w := decrypt(licenses["acme"], "acme-consumer-key-0123456789")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "report of acme", w.Body.String())
+	w = decrypt(licenses["globex"], "globex-consumer-key-0123456789")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "report of globex", w.Body.String())
+
+	// A license key leaked to another tenant is useless there
+	w = decrypt(licenses["acme"], "globex-consumer-key-0123456789")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrLicenseNotFound.Code)
+
+	// Listings only show the caller's tenant
+	req, _ := http.NewRequest("GET", "/sles/api/v1/fetch-license", nil)
+	listed := map[uuid.UUID]License{}
+	json.Unmarshal(do(req, "acme-admin-key-0123456789").Body.Bytes(), &listed)
+	assert.Len(t, listed, 1)
+	assert.Contains(t, listed, licenses["acme"].Key)
+
+	req, _ = http.NewRequest("GET", "/sles/api/v1/encrypt-file", nil)
+	files := map[string]FileRecord{}
+	json.Unmarshal(do(req, "globex-admin-key-0123456789").Body.Bytes(), &files)
+	assert.Len(t, files, 1)
+	assert.Equal(t, licenses["globex"].Key, files[fileIDs["globex"]].LicenseKey)
+	assert.Equal(t, "report.txt", files[fileIDs["globex"]].OriginalName)
+}
+
+func TestBoltStoreMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DB_FILE)
+	license := License{Key: uuid.New(), Type: USAGE_LIMITED, TokensLeft: budget(3)}
+	timeBound := License{Key: uuid.New()}
+
+	// A database written before tenants and file ids existed
+	db, _ := bolt.Open(path, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists(metaBucket)
+		for _, migration := range migrations[:2] {
+			migration(tx)
+		}
+		raw, _ := json.Marshal(license)
+		tx.Bucket(licensesBucket).Put(license.Key[:], raw)
+		tx.Bucket(licensesBucket).Put(timeBound.Key[:], []byte(`{"key":"`+timeBound.Key.String()+`","type":"time-bound","expiryDate":"2030-01-01T00:00:00Z","tokensLeft":0}`))
+		tx.Bucket(filesBucket).Put([]byte("report.enc"), []byte(`{"name":"report.enc","licenseKey":"`+license.Key.String()+`"}`))
+		tx.Bucket(linksBucket).Put([]byte("link"), []byte(`{"id":"link","filepath":"report.enc","licenseKey":"`+license.Key.String()+`"}`))
+		return meta.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, 2))
+	})
+	db.Close()
+
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err.Error())
+	}
+	defer store.Close()
+
+	stored, _ := store.GetLicense(license.Key)
+	assert.Equal(t, DEFAULT_TENANT, stored.Tenant)
+	assert.Equal(t, LICENSE_ACTIVE, stored.Status)
+	assert.Equal(t, budget(3), stored.TokensLeft)
+
+	// Time-bound licenses don't get an exhausted token budget
+	stored, _ = store.GetLicense(timeBound.Key)
+	assert.Nil(t, stored.TokensLeft)
+	assert.NoError(t, CheckLicense(stored, OP_DECRYPT, time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// Existing files stay where they were written and keep their name as id
+	record, err := store.GetFile(DEFAULT_TENANT, "report.enc")
+	assert.NoError(t, err)
+	assert.Equal(t, "report.enc", record.Path)
+	assert.Equal(t, "report", record.DownloadName())
+	assert.Equal(t, KEY_MANAGER_LOCAL, record.KeyManager)
+	files, _ := store.ListFiles(DEFAULT_TENANT)
+	assert.Len(t, files, 1)
+
+	link, _ := store.GetLink("link")
+	assert.Equal(t, DEFAULT_TENANT, link.Tenant)
+	assert.Equal(t, "report.enc", link.FileID)
+}
+
+// spoolCheckingWriter records the files left in dir when the response body
+// starts.
+type spoolCheckingWriter struct {
+	*httptest.ResponseRecorder
+	dir     string
+	checked bool
+	spooled []os.DirEntry
+}
+
+func (w *spoolCheckingWriter) Write(p []byte) (int, error) {
+	if !w.checked {
+		w.spooled, _ = os.ReadDir(w.dir)
+		w.checked = true
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestEncryptDropsUploadSpool(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	license := newLicense(t, r, "time-bound", 30)
+
+	// Uploads over the memory limit are spooled to the temp directory
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	req := encryptRequest(license.Key.String(), "large.bin", bytes.Repeat([]byte("plain"), 1000))
+	assert.NoError(t, req.ParseMultipartForm(1))
+	spooled, _ := os.ReadDir(spool)
+	assert.NotEmpty(t, spooled)
+
+	// The plaintext is gone before the encrypted file is sent
+	w := &spoolCheckingWriter{ResponseRecorder: httptest.NewRecorder(), dir: spool}
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.checked)
+	assert.Empty(t, w.spooled)
+}
+
+func TestUploadsWithSameNameAreKeptApart(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+
+	license := newLicense(t, r, USAGE_LIMITED, 10)
+	ids := []string{}
+	for _, content := range []string{"first", "second"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "../../etc/report.txt", []byte(content)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		ids = append(ids, w.Header().Get(FILE_ID_HEADER))
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+
+	for i, content := range []string{"first", "second"} {
+		req, _ := http.NewRequest("GET", "/decrypt-file?licensekey="+license.Key.String()+"&fileid="+ids[i], nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, content, w.Body.String())
+		// Only the last element of the client's name is kept
+		assert.Equal(t, `attachment; filename=report.txt`, w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"report.pdf":                "report.pdf",
+		"../../etc/passwd":          "passwd",
+		`C:\Users\me\report.pdf`:    "report.pdf",
+		"/":                         "file",
+		"..":                        "file",
+		"":                          "file",
+		"reports/2024/summary.xlsx": "summary.xlsx",
+	} {
+		assert.Equal(t, expected, SanitizeFileName(name), name)
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "tenants", "acme"), 0700)
+	os.WriteFile(filepath.Join(root, "tenants", "acme", "report.enc"), []byte("data"), 0600)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+
+	// Links staying inside the root are fine, escaping ones are not
+	os.Symlink(filepath.Join(root, "tenants", "acme"), filepath.Join(root, "tenants", "alias"))
+	os.Symlink(outside, filepath.Join(root, "tenants", "escape"))
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "tenants", "acme", "secret.enc"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "tenants", "acme", "dangling.enc"))
+
+	realRoot, _ := filepath.EvalSymlinks(root)
+	for rel, expected := range map[string]string{
+		"tenants/acme/report.enc":  filepath.Join(realRoot, "tenants", "acme", "report.enc"),
+		"tenants/acme/new.enc":     filepath.Join(realRoot, "tenants", "acme", "new.enc"),
+		"tenants/globex/new.enc":   filepath.Join(realRoot, "tenants", "globex", "new.enc"),
+		"tenants/alias/report.enc": filepath.Join(realRoot, "tenants", "acme", "report.enc"),
+		"report.enc":               filepath.Join(realRoot, "report.enc"),
+	} {
+		path, err := SafePath(root, rel)
+		assert.NoError(t, err, rel)
+		assert.Equal(t, expected, path, rel)
+	}
+
+	for _, rel := range []string{
+		"",
+		".",
+		"tenants/..",
+		"/etc/passwd",
+		filepath.Join(outside, "secret"),
+		"../secret",
+		"tenants/../../secret",
+		"tenants/acme/../../../secret",
+		`..\..\secret`,
+		`tenants\acme\report.enc`,
+		"tenants/escape/secret",
+		"tenants/escape/new.enc",
+		"tenants/acme/secret.enc",
+		"tenants/acme/dangling.enc",
+	} {
+		_, err := SafePath(root, rel)
+		assert.ErrorIs(t, err, ErrInvalidPath, rel)
+	}
+}
+
+func TestHostileFileIDs(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
+
+	license := newLicense(t, r, USAGE_LIMITED, 10)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "report.txt", []byte("Hello world")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	// A registry entry pointing outside the storage directory is never opened
+	outside := filepath.Join(t.TempDir(), "outside.enc")
+	os.WriteFile(outside, []byte("not for you"), 0600)
+	s.Files.PutFile(FileRecord{ID: "tampered", Tenant: DEFAULT_TENANT, Path: "../" + filepath.Base(filepath.Dir(outside)) + "/outside.enc", LicenseKey: license.Key})
+	s.Files.PutFile(FileRecord{ID: "absolute", Tenant: DEFAULT_TENANT, Path: outside, LicenseKey: license.Key})
+
+	for _, id := range []string{
+		"../../etc/passwd",
+		"/etc/passwd",
+		"..",
+		`..\..\windows\win.ini`,
+		"tenants/default/" + fileID,
+		"../" + fileID,
+		"tampered",
+		"absolute",
+	} {
+		req, _ := http.NewRequest("GET", "/decrypt-file?"+url.Values{"licensekey": {license.Key.String()}, "fileid": {id}}.Encode(), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, id)
+		assert.Contains(t, w.Body.String(), ErrInvalidPath.Code, id)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: license.Key.String(), FileID: id}))
+		assert.Equal(t, http.StatusBadRequest, w.Code, id)
+	}
+
+	// Nothing was spent on the rejected requests
+	stored, _ := s.Licenses.GetLicense(license.Key)
+	assert.Equal(t, budget(9), stored.TokensLeft)
+}
+
+func TestLicenseLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/licenses/:key", s.GetLicenseDetails)
+	r.PATCH("/licenses/:key", s.UpdateLicenseTerms)
+	r.POST("/licenses/:key/suspend", s.SuspendLicense)
+	r.POST("/licenses/:key/resume", s.ResumeLicense)
+	r.POST("/licenses/:key/revoke", s.RevokeLicense)
+	r.DELETE("/licenses/:key", s.DeleteLicense)
+
+	do := func(method string, path string, body any) (*httptest.ResponseRecorder, License) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest(method, path, body))
+		license := License{}
+		json.Unmarshal(w.Body.Bytes(), &license)
+		return w, license
+	}
+	encrypt := func(license License) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "lifecycle.txt", []byte("Hello world")))
+		return w
+	}
+
+	timeBound := newLicense(t, r, TIME_BOUND, 7)
+	usageLimited := newLicense(t, r, USAGE_LIMITED, 2)
+	assert.Equal(t, LICENSE_ACTIVE, timeBound.Status)
+
+	w, got := do("GET", "/licenses/"+timeBound.Key.String(), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, timeBound.Key, got.Key)
+
+	// Extend and top up
+	w, got = do("PATCH", "/licenses/"+timeBound.Key.String(), LicenseUpdate{ExtendDays: 3})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.WithinDuration(t, timeBound.ExpiryDate.AddDate(0, 0, 3), got.ExpiryDate, time.Second)
+
+	w, got = do("PATCH", "/licenses/"+usageLimited.Key.String(), LicenseUpdate{AddTokens: 5})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, budget(7), got.TokensLeft)
+
+	for _, update := range []LicenseUpdate{{}, {AddTokens: 5}, {ExtendDays: -1}, {ExtendDays: 1, AddTokens: 1}} {
+		w, _ = do("PATCH", "/licenses/"+timeBound.Key.String(), update)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%+v", update)
+		assert.Contains(t, w.Body.String(), ErrInvalidLicenseUpdate.Code)
+	}
+
+	// Expired licenses are extended from today
+	expired := License{Key: uuid.New(), Type: TIME_BOUND, ExpiryDate: s.Clock.Now().AddDate(0, 0, -10), Tenant: DEFAULT_TENANT, Status: LICENSE_ACTIVE}
+	s.Licenses.PutLicense(expired)
+	assert.Contains(t, encrypt(expired).Body.String(), ErrLicenseExpired.Code)
+	w, got = do("PATCH", "/licenses/"+expired.Key.String(), LicenseUpdate{ExtendDays: 1})
+	assert.Equal(t, s.Clock.Now().AddDate(0, 0, 1), got.ExpiryDate)
+	assert.Equal(t, http.StatusOK, encrypt(expired).Code)
+
+	// Suspend and resume
+	w, got = do("POST", "/licenses/"+timeBound.Key.String()+"/suspend", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, LICENSE_SUSPENDED, got.Status)
+	w = encrypt(timeBound)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrLicenseSuspended.Code)
+
+	w, got = do("POST", "/licenses/"+timeBound.Key.String()+"/resume", nil)
+	assert.Equal(t, LICENSE_ACTIVE, got.Status)
+	assert.Equal(t, http.StatusOK, encrypt(timeBound).Code)
+
+	// Revoking is final
+	w, got = do("POST", "/licenses/"+timeBound.Key.String()+"/revoke", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, LICENSE_REVOKED, got.Status)
+	w = encrypt(timeBound)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrLicenseRevoked.Code)
+
+	for _, path := range []string{"/resume", "/suspend", ""} {
+		method := "POST"
+		var body any
+		if path == "" {
+			method, body = "PATCH", LicenseUpdate{ExtendDays: 1}
+		}
+		w, _ = do(method, "/licenses/"+timeBound.Key.String()+path, body)
+		assert.Equal(t, http.StatusConflict, w.Code, path)
+		assert.Contains(t, w.Body.String(), ErrLicenseStatus.Code)
+	}
+
+	// Delete
+	w, _ = do("DELETE", "/licenses/"+usageLimited.Key.String(), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w, _ = do("GET", "/licenses/"+usageLimited.Key.String(), nil)
+	assert.Contains(t, w.Body.String(), ErrLicenseNotFound.Code)
+	w, _ = do("DELETE", "/licenses/"+usageLimited.Key.String(), nil)
+	assert.Contains(t, w.Body.String(), ErrLicenseNotFound.Code)
+	w, _ = do("GET", "/licenses/not-a-uuid", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Other tenants' licenses can't be seen or changed
+	foreign := License{Key: uuid.New(), Type: USAGE_LIMITED, TokensLeft: budget(1), Tenant: "globex", Status: LICENSE_ACTIVE}
+	s.Licenses.PutLicense(foreign)
+	for _, req := range [][]string{{"GET", ""}, {"POST", "/revoke"}, {"DELETE", ""}} {
+		w, _ = do(req[0], "/licenses/"+foreign.Key.String()+req[1], nil)
+		assert.Contains(t, w.Body.String(), ErrLicenseNotFound.Code, req)
+	}
+	stored, err := s.Licenses.GetLicense(foreign.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, LICENSE_ACTIVE, stored.Status)
+}
+
+func TestHybridLicenses(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.PATCH("/licenses/:key", s.UpdateLicenseTerms)
+
+	generate := func(request LicenseRequest) (*httptest.ResponseRecorder, License) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/generate-license", request))
+		license := License{}
+		json.Unmarshal(w.Body.Bytes(), &license)
+		return w, license
+	}
+	encrypt := func(license License) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "hybrid.txt", []byte("Hello world")))
+		return w
+	}
+	decrypt := func(license License, fileID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil))
+		return w
+	}
+
+	// 2 decryptions within 30 days, encryption is only bound by the expiry
+	w, hybrid := generate(LicenseRequest{Type: HYBRID, Days: 30, DecryptTokens: 2})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, s.Clock.Now().AddDate(0, 0, 30), hybrid.ExpiryDate)
+	assert.Nil(t, hybrid.TokensLeft)
+	assert.Nil(t, hybrid.EncryptTokensLeft)
+	assert.Equal(t, budget(2), hybrid.DecryptTokensLeft)
+
+	var fileID string
+	for i := 0; i < 3; i++ {
+		w = encrypt(hybrid)
+		assert.Equal(t, http.StatusOK, w.Code)
+		fileID = w.Header().Get(FILE_ID_HEADER)
+	}
+	assert.Equal(t, http.StatusOK, decrypt(hybrid, fileID).Code)
+	assert.Equal(t, http.StatusOK, decrypt(hybrid, fileID).Code)
+	w = decrypt(hybrid, fileID)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrLicenseExpired.Code)
+	assert.Contains(t, w.Body.String(), "decryptTokens")
+	assert.Equal(t, http.StatusOK, encrypt(hybrid).Code)
+
+	// Only budgets the license has can be topped up
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("PATCH", "/licenses/"+hybrid.Key.String(), LicenseUpdate{AddEncryptTokens: 1}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("PATCH", "/licenses/"+hybrid.Key.String(), LicenseUpdate{AddDecryptTokens: 1}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, decrypt(hybrid, fileID).Code)
+
+	// The total budget is shared by both operations
+	_, shared := generate(LicenseRequest{Type: HYBRID, Tokens: 2, EncryptTokens: 5})
+	w = encrypt(shared)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, decrypt(shared, w.Header().Get(FILE_ID_HEADER)).Code)
+	assert.Contains(t, encrypt(shared).Body.String(), ErrLicenseExpired.Code)
+	stored, _ := s.Licenses.GetLicense(shared.Key)
+	assert.Equal(t, budget(0), stored.TokensLeft)
+	assert.Equal(t, budget(4), stored.EncryptTokensLeft)
+
+	// Perpetual licenses never run out
+	w, perpetual := generate(LicenseRequest{Type: PERPETUAL})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.True(t, perpetual.ExpiryDate.IsZero())
+	assert.NoError(t, CheckLicense(perpetual, OP_DECRYPT, s.Clock.Now().AddDate(100, 0, 0)))
+	assert.Equal(t, http.StatusOK, encrypt(perpetual).Code)
+
+	// Licenses starting later can't be used yet, their days count from the start
+	start := s.Clock.Now().AddDate(0, 0, 10)
+	w, later := generate(LicenseRequest{Type: TIME_BOUND, Expiry: 5, NotBefore: &start})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.WithinDuration(t, start.AddDate(0, 0, 5), later.ExpiryDate, time.Second)
+	w = encrypt(later)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrLicenseNotYetValid.Code)
+	assert.NoError(t, CheckLicense(later, OP_ENCRYPT, start.Add(time.Hour)))
+
+	for _, request := range []LicenseRequest{
+		{Type: HYBRID},
+		{Type: HYBRID, Expiry: 5},
+		{Type: HYBRID, Days: 5, Tokens: -1},
+		{Type: PERPETUAL, Expiry: 5},
+		{Type: PERPETUAL, Days: 5},
+		{Type: TIME_BOUND, Expiry: 5, DecryptTokens: 5},
+	} {
+		w, _ = generate(request)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%+v", request)
+		assert.Contains(t, w.Body.String(), ErrInvalidExpiry.Code, "%+v", request)
+	}
+}
+
+func TestRateLimitWindows(t *testing.T) {
+	hourly := RateLimit{Operation: OP_DECRYPT, Window: Duration{time.Hour}, MaxRequests: 2}
+	daily := RateLimit{Window: Duration{24 * time.Hour}, MaxBytes: 100}
+	limits := []RateLimit{hourly, daily}
+	counters := map[string]RateCounter{}
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	status, err := AcquireRate(counters, limits, OP_DECRYPT, 10, start)
+	assert.NoError(t, err)
+	assert.Equal(t, hourly, status.Limit)
+	assert.Equal(t, int64(1), status.Remaining)
+	assert.Equal(t, time.Hour, status.Reset)
+	_, err = AcquireRate(counters, limits, OP_DECRYPT, 10, start.Add(time.Minute))
+	assert.NoError(t, err)
+
+	// Rejected requests aren't counted
+	_, err = AcquireRate(counters, limits, OP_DECRYPT, 10, start.Add(2*time.Minute))
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int64(2), counters[hourly.Name()].Current)
+	assert.Equal(t, int64(20), counters[daily.Name()].Current)
+
+	// Encryptions only count against the shared byte limit
+	status, err = AcquireRate(counters, limits, OP_ENCRYPT, 50, start.Add(3*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, daily, status.Limit)
+	assert.Equal(t, int64(30), status.Remaining)
+	_, err = AcquireRate(counters, limits, OP_ENCRYPT, 31, start.Add(4*time.Minute))
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	// The previous hour still weighs 2 * 3/4 at a quarter past, one more
+	// request fits once it faded to half
+	_, err = AcquireRate(counters, limits, OP_DECRYPT, 1, start.Add(75*time.Minute))
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int64(15*60), err.(*APIError).Details.(gin.H)["retryAfter"])
+	_, err = AcquireRate(counters, limits, OP_DECRYPT, 1, start.Add(105*time.Minute))
+	assert.NoError(t, err)
+
+	// Windows long past are forgotten
+	_, err = AcquireRate(counters, limits, OP_ENCRYPT, 100, start.Add(72*time.Hour))
+	assert.NoError(t, err)
+	_, err = AcquireRate(counters, limits, OP_ENCRYPT, 101, start.Add(200*time.Hour))
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Nil(t, err.(*APIError).Details.(gin.H)["retryAfter"])
+}
+
+func TestRateLimitedLicense(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{
+		Type:       USAGE_LIMITED,
+		Expiry:     10,
+		RateLimits: []RateLimit{{Operation: OP_DECRYPT, Window: Duration{time.Hour}, MaxRequests: 2}},
+	}))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "limited.txt", []byte("Hello world")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(RATE_LIMIT_HEADER))
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	decrypt := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil))
+		return w
+	}
+	for _, remaining := range []string{"1", "0"} {
+		w = decrypt()
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get(RATE_LIMIT_HEADER))
+		assert.Equal(t, remaining, w.Header().Get(RATE_REMAINING_HEADER))
+		assert.NotEmpty(t, w.Header().Get(RATE_RESET_HEADER))
+	}
+
+	w = decrypt()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), ErrRateLimited.Code)
+	assert.Equal(t, "0", w.Header().Get(RATE_REMAINING_HEADER))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// The rejected decryption didn't cost a token
+	stored, _ := s.Licenses.GetLicense(license.Key)
+	assert.Equal(t, budget(7), stored.TokensLeft)
+
+	for _, limit := range []RateLimit{
+		{Window: Duration{time.Hour}},
+		{Window: Duration{time.Hour}, MaxRequests: 1, MaxBytes: 1},
+		{Window: Duration{time.Millisecond}, MaxRequests: 1},
+		{Operation: "share", Window: Duration{time.Hour}, MaxRequests: 1},
+	} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: PERPETUAL, RateLimits: []RateLimit{limit}}))
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%+v", limit)
+		assert.Contains(t, w.Body.String(), ErrInvalidRateLimit.Code)
+	}
+}
+
+func TestBoltStoreRateCounters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DB_FILE)
+	key := uuid.New()
+	limits := []RateLimit{{Window: Duration{time.Hour}, MaxRequests: 1}}
+	now := time.Now()
+
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err.Error())
+	}
+	_, err = store.AcquireRate(key, limits, OP_ENCRYPT, 1, now)
+	assert.NoError(t, err)
+	store.Close()
+
+	// The counters survive a restart
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err.Error())
+	}
+	defer store.Close()
+	_, err = store.AcquireRate(key, limits, OP_ENCRYPT, 1, now)
+	assert.ErrorIs(t, err, ErrRateLimited)
+}
+
+func TestRefusedLinkDownloads(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
+	r.PATCH("/licenses/:key", s.UpdateLicenseTerms)
+	r.GET("/secure-file", s.SecureFileAccess)
+
+	content := []byte("shared content")
+	limits := []RateLimit{{Operation: OP_DECRYPT, Window: Duration{time.Hour}, MaxRequests: 1}}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: HYBRID, Tokens: 5, Bytes: int64(len(content)) + 1, RateLimits: limits}))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "linked.txt", content))
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: license.Key.String(), FileID: fileID}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var resp struct {
+		URL  string
+		Link LinkRecord
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	link, _ := url.Parse(resp.URL)
+
+	get := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/secure-file?token="+url.QueryEscape(link.Query().Get("token")), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	state := func() (int, int, int64) {
+		stored, _ := s.Links.GetLink(resp.Link.ID)
+		license, _ := s.Licenses.GetLicense(license.Key)
+		return stored.Downloads, *license.TokensLeft, *license.BytesLeft
+	}
+
+	// A download over the byte quota doesn't count against the link or the
+	// rate limit
+	w = get()
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrQuotaExceeded.Code)
+	downloads, tokens, bytesLeft := state()
+	assert.Equal(t, 0, downloads)
+	assert.Equal(t, 4, tokens)
+	assert.Equal(t, int64(1), bytesLeft)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("PATCH", "/licenses/"+license.Key.String(), LicenseUpdate{AddBytes: int64(len(content))}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = get()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	downloads, tokens, bytesLeft = state()
+	assert.Equal(t, 1, downloads)
+	assert.Equal(t, 3, tokens)
+	assert.Equal(t, int64(1), bytesLeft)
+
+	// A rate limited download gets its token and bytes back
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("PATCH", "/licenses/"+license.Key.String(), LicenseUpdate{AddBytes: int64(len(content))}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = get()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	downloads, tokens, bytesLeft = state()
+	assert.Equal(t, 1, downloads)
+	assert.Equal(t, 3, tokens)
+	assert.Equal(t, int64(len(content))+1, bytesLeft)
+}
+
+func TestByteQuotas(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.PATCH("/licenses/:key", s.UpdateLicenseTerms)
+	r.GET("/licenses/:key/usage", s.GetLicenseUsage)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: HYBRID, Bytes: 3 * CHUNK_SIZE}))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+	assert.Equal(t, budget(int64(3*CHUNK_SIZE)), license.BytesLeft)
+
+	encrypt := func(content []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "quota.bin", content))
+		return w
+	}
+	bytesLeft := func() int64 {
+		stored, _ := s.Licenses.GetLicense(license.Key)
+		return *stored.BytesLeft
+	}
+
+	// Large uploads cost more than small ones
+	w = encrypt(make([]byte, 2*CHUNK_SIZE))
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+	assert.Equal(t, int64(CHUNK_SIZE), bytesLeft())
+
+	// Uploads that don't fit are refused without spending anything or
+	// leaving a file behind
+	before, _ := os.ReadDir(s.Blobs.TenantDir(DEFAULT_TENANT))
+	w = encrypt(make([]byte, CHUNK_SIZE+1))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrQuotaExceeded.Code)
+	assert.Equal(t, int64(CHUNK_SIZE), bytesLeft())
+	after, _ := os.ReadDir(s.Blobs.TenantDir(DEFAULT_TENANT))
+	assert.Equal(t, len(before), len(after))
+
+	// Same for decryption, before anything is streamed
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrQuotaExceeded.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("PATCH", "/licenses/"+license.Key.String(), LicenseUpdate{AddBytes: CHUNK_SIZE}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2*CHUNK_SIZE, w.Body.Len())
+	assert.Equal(t, int64(0), bytesLeft())
+
+	// An exhausted budget is reported like an exhausted license
+	w = encrypt([]byte("a"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrQuotaExceeded.Code)
+
+	// Every operation is recorded with its volume
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("GET", "/licenses/"+license.Key.String()+"/usage", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	usage := struct {
+		TotalBytes map[string]int64 `json:"totalBytes"`
+		Operations []UsageRecord    `json:"operations"`
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, map[string]int64{OP_ENCRYPT: 2 * CHUNK_SIZE, OP_DECRYPT: 2 * CHUNK_SIZE}, usage.TotalBytes)
+	if assert.Len(t, usage.Operations, 2) {
+		assert.Equal(t, OP_ENCRYPT, usage.Operations[0].Operation)
+		assert.Equal(t, fileID, usage.Operations[1].FileID)
+		assert.True(t, usage.Operations[1].Complete)
+	}
+}
+
+func TestLicenseMeter(t *testing.T) {
+	s := newTestServer(t)
+	license := License{Key: uuid.New(), Type: HYBRID, BytesLeft: budget(int64(10)), Tenant: DEFAULT_TENANT, Status: LICENSE_ACTIVE}
+	s.Licenses.PutLicense(license)
+
+	// Streams growing past the expected size reserve more as they go, until
+	// the budget is gone
+	meter, err := s.newLicenseMeter(license, 4)
+	assert.NoError(t, err)
+	assert.NoError(t, meter.Charge(4))
+	assert.NoError(t, meter.Charge(5))
+	assert.ErrorIs(t, meter.Charge(2), ErrQuotaExceeded)
+	assert.Equal(t, int64(9), meter.settle(true))
+
+	stored, _ := s.Licenses.GetLicense(license.Key)
+	assert.Equal(t, budget(int64(1)), stored.BytesLeft)
+
+	// Failed operations are refunded
+	meter, err = s.newLicenseMeter(stored, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, meter.Charge(1))
+	assert.Equal(t, int64(0), meter.settle(false))
+	stored, _ = s.Licenses.GetLicense(license.Key)
+	assert.Equal(t, budget(int64(1)), stored.BytesLeft)
+
+	// Licenses without a byte budget are only counted
+	meter, err = s.newLicenseMeter(License{Key: uuid.New()}, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, meter.Charge(1000))
+	assert.Equal(t, int64(1000), meter.settle(true))
+}
+
+func TestServersHaveTheirOwnSigningKeys(t *testing.T) {
+	first, second := newTestServer(t), newTestServer(t)
+
+	// Links and license tokens of one server aren't accepted by another
+	linkID, token, err := first.NewLinkToken()
+	assert.NoError(t, err)
+	parsed, ok := first.ParseLinkToken(token)
+	assert.True(t, ok)
+	assert.Equal(t, linkID, parsed)
+	_, ok = second.ParseLinkToken(token)
+	assert.False(t, ok)
+
+	license := License{Key: uuid.New(), Type: PERPETUAL, Tenant: DEFAULT_TENANT}
+	signed, err := first.SignLicense(license)
+	assert.NoError(t, err)
+	key, err := first.ParseLicenseKey(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, license.Key, key)
+	_, err = second.ParseLicenseKey(signed)
+	assert.ErrorIs(t, err, ErrInvalidLicenseKey)
+
+	// A server needs a master secret
+	cfg := DefaultConfig()
+	cfg.StorageDir = t.TempDir()
+	_, err = NewServer(cfg, NewMemoryStore(), NewFakeKeyManager(), nil, first.Log)
+	assert.Error(t, err)
+}
+
+func TestSignedLicenses(t *testing.T) {
+	s := newTestServer(t)
+	r := s.Router()
+	issuerKey, consumerKey := testCredentials[1].Key, testCredentials[2].Key
+	api := "/sles/api/v1"
+
+	do := func(req *http.Request, apiKey string) *httptest.ResponseRecorder {
+		if req.URL.Path == "/encrypt-file" {
+			req.URL.Path = api + req.URL.Path
+		}
+		if apiKey != "" {
+			req.Header.Set(API_KEY_HEADER, apiKey)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(jsonRequest("POST", api+"/generate-license", LicenseRequest{Type: HYBRID, Days: 30, DecryptTokens: 5, Features: []string{"share-link"}, Signed: true}), issuerKey)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+	assert.True(t, licensetoken.LooksLikeToken(license.Token))
+
+	// Clients verify the token offline with the published keys
+	w = do(jsonRequest("GET", LICENSE_KEYS_PATH, nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	keys, err := licensetoken.ParseKeySet(w.Body.Bytes())
+	assert.NoError(t, err)
+	claims, err := licensetoken.Verify(license.Token, keys, s.Clock.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, license.Key.String(), claims.ID)
+	assert.Equal(t, HYBRID, claims.Type)
+	assert.Equal(t, license.Tenant, claims.Tenant)
+	assert.Equal(t, license.ExpiryDate.Unix(), claims.Expiry)
+	assert.Equal(t, budget(5), claims.Limits.DecryptTokens)
+	assert.True(t, claims.HasFeature("share-link"))
+	_, err = licensetoken.Verify(license.Token, keys, s.Clock.Now().AddDate(0, 0, 31))
+	assert.ErrorIs(t, err, licensetoken.ErrExpired)
+
+	// The server takes the token wherever it takes the bare key
+	w = do(encryptRequest(license.Token, "signed.txt", []byte("Hello world")), consumerKey)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	fileID := w.Header().Get(FILE_ID_HEADER)
+	w = do(jsonRequest("GET", fmt.Sprintf("%s/decrypt-file?licensekey=%s&fileid=%s", api, license.Key, fileID), nil), consumerKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(jsonRequest("GET", fmt.Sprintf("%s/decrypt-file?licensekey=%s&fileid=%s", api, license.Token, fileID), nil), consumerKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello world", w.Body.String())
+
+	// Extending the license issues a token with the new terms
+	w = do(jsonRequest("PATCH", api+"/licenses/"+license.Token, LicenseUpdate{ExtendDays: 10}), issuerKey)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	extended := License{}
+	json.Unmarshal(w.Body.Bytes(), &extended)
+	claims, err = licensetoken.Verify(extended.Token, keys, s.Clock.Now().AddDate(0, 0, 31))
+	assert.NoError(t, err)
+	assert.Equal(t, budget(3), claims.Limits.DecryptTokens)
+
+	// Tokens not signed by the server are refused
+	_, foreignKey, _ := ed25519.GenerateKey(nil)
+	forged, _ := licensetoken.Sign(s.LicenseClaims(license), foreignKey)
+	parts := strings.Split(license.Token, ".")
+	for _, token := range []string{forged, parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))} {
+		w = do(encryptRequest(token, "forged.txt", []byte("Hello world")), consumerKey)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), ErrInvalidLicenseKey.Code)
+	}
+
+	// Revocation on the server wins over a token that is still valid offline
+	w = do(jsonRequest("POST", api+"/licenses/"+license.Key.String()+"/revoke", nil), issuerKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(encryptRequest(license.Token, "signed.txt", []byte("Hello world")), consumerKey)
+	assert.Contains(t, w.Body.String(), ErrLicenseRevoked.Code)
+}
+
+func TestLicenseScopes(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
+
+	generate := func(request LicenseRequest) (*httptest.ResponseRecorder, License) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/generate-license", request))
+		license := License{}
+		json.Unmarshal(w.Body.Bytes(), &license)
+		return w, license
+	}
+	encrypt := func(license License, fileName string, content []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), fileName, content))
+		return w
+	}
+	decrypt := func(license License, fileID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil))
+		return w
+	}
+	share := func(license License, fileID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: license.Key.String(), FileID: fileID}))
+		return w
+	}
+
+	// A publisher encrypts PDFs of up to 1 KiB
+	w, publisher := generate(LicenseRequest{Type: PERPETUAL, Scopes: &LicenseScopes{Operations: []string{OP_ENCRYPT}, MaxFileSize: 1024, MimeTypes: []string{"application/pdf"}}})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = encrypt(publisher, "book.pdf", []byte("%PDF-1.7"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	book := w.Header().Get(FILE_ID_HEADER)
+	w = encrypt(publisher, "other.pdf", []byte("%PDF-1.7"))
+	other := w.Header().Get(FILE_ID_HEADER)
+
+	for _, w := range []*httptest.ResponseRecorder{
+		encrypt(publisher, "notes.txt", []byte("text")),
+		encrypt(publisher, "big.pdf", make([]byte, 1025)),
+		decrypt(publisher, book),
+		share(publisher, book),
+	} {
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), ErrScopeDenied.Code)
+	}
+
+	// End users decrypt the book they bought, and nothing else
+	w, reader := generate(LicenseRequest{Type: USAGE_LIMITED, Expiry: 3, Scopes: &LicenseScopes{Operations: []string{OP_DECRYPT}, FileIDs: []string{book}}})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = decrypt(reader, book)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "%PDF-1.7", w.Body.String())
+	assert.Contains(t, decrypt(reader, other).Body.String(), ErrIncorrectKey.Code)
+	assert.Contains(t, encrypt(reader, "mine.pdf", []byte("%PDF")).Body.String(), ErrScopeDenied.Code)
+	assert.Contains(t, share(reader, book).Body.String(), ErrScopeDenied.Code)
+
+	// The reader's license pays for the decryption, not the publisher's
+	stored, _ := s.Licenses.GetLicense(reader.Key)
+	assert.Equal(t, budget(2), stored.TokensLeft)
+
+	// Sharing needs its own scope
+	_, sharer := generate(LicenseRequest{Type: PERPETUAL, Scopes: &LicenseScopes{Operations: []string{OP_SHARE_LINK}, FileIDs: []string{book}}})
+	assert.Equal(t, http.StatusCreated, share(sharer, book).Code)
+
+	// Licenses without scopes can still do everything with their own files
+	_, unscoped := generate(LicenseRequest{Type: PERPETUAL})
+	w = encrypt(unscoped, "notes.txt", []byte("text"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, decrypt(unscoped, w.Header().Get(FILE_ID_HEADER)).Code)
+	assert.Contains(t, decrypt(unscoped, book).Body.String(), ErrIncorrectKey.Code)
+
+	for _, scopes := range []LicenseScopes{
+		{},
+		{Operations: []string{"print"}},
+		{Operations: []string{OP_DECRYPT}, MimeTypes: []string{"pdf"}},
+		{Operations: []string{OP_DECRYPT}, MimeTypes: []string{"image/["}},
+		{Operations: []string{OP_DECRYPT}, FileIDs: []string{"../secret"}},
+		{Operations: []string{OP_DECRYPT}, MaxFileSize: -1},
+	} {
+		w, _ = generate(LicenseRequest{Type: PERPETUAL, Scopes: &scopes})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%+v", scopes)
+		assert.Contains(t, w.Body.String(), ErrInvalidScopes.Code)
+	}
+}
+
+func TestExpiryBoundaries(t *testing.T) {
+	s := newTestServer(t)
+	clock := s.Clock.(*fakeClock)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.POST("/generate-link", s.GenerateSecureURL)
+	r.GET(SECURE_FILE_PATH, s.SecureFileAccess)
+
+	encrypt := func(license License) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "boundary.txt", []byte("Hello world")))
+		return w
+	}
+	download := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", SECURE_FILE_PATH+"?token="+url.QueryEscape(token), nil))
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: TIME_BOUND, Expiry: 1, Signed: true}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+	assert.Equal(t, clock.Now().Add(24*time.Hour), license.ExpiryDate)
+
+	w = encrypt(license)
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID := w.Header().Get(FILE_ID_HEADER)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-link", URLRequest{LicenseKey: license.Key.String(), FileID: fileID}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var resp struct {
+		URL string
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	link, _ := url.Parse(resp.URL)
+	token := link.Query().Get("token")
+
+	// Links work until the instant they expire
+	clock.Advance(s.Config.LinkTTL.Duration - time.Nanosecond)
+	assert.Equal(t, http.StatusOK, download(token).Code)
+	clock.Advance(time.Nanosecond)
+	assert.Contains(t, download(token).Body.String(), ErrLinkExpired.Code)
+
+	// So do licenses
+	clock.Advance(license.ExpiryDate.Sub(clock.Now()) - time.Nanosecond)
+	assert.Equal(t, http.StatusOK, encrypt(license).Code)
+	clock.Advance(time.Nanosecond)
+	assert.Contains(t, encrypt(license).Body.String(), ErrLicenseExpired.Code)
+
+	// Their tokens expire at the same instant offline
+	keys := s.licenseKeySet()
+	_, err := licensetoken.Verify(license.Token, keys, license.ExpiryDate.Add(-time.Second))
+	assert.NoError(t, err)
+	_, err = licensetoken.Verify(license.Token, keys, license.ExpiryDate)
+	assert.ErrorIs(t, err, licensetoken.ErrExpired)
+
+	// Licenses starting later can be used from the instant they start
+	start := clock.Now().Add(time.Hour)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: TIME_BOUND, Expiry: 1, NotBefore: &start}))
+	later := License{}
+	json.Unmarshal(w.Body.Bytes(), &later)
+	clock.Advance(time.Hour - time.Nanosecond)
+	assert.Contains(t, encrypt(later).Body.String(), ErrLicenseNotYetValid.Code)
+	clock.Advance(time.Nanosecond)
+	assert.Equal(t, http.StatusOK, encrypt(later).Code)
+}
+
+func TestExpiryAcrossDaylightSaving(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clocks go forward on March 8th and back on November 1st, 2026. Days are
+	// 24 hours all the same, on the wall clock the expiry moves by an hour.
+	for _, tc := range []struct {
+		start      time.Time
+		expiryHour int
+	}{
+		{time.Date(2026, 3, 7, 12, 0, 0, 0, newYork), 13},
+		{time.Date(2026, 10, 31, 12, 0, 0, 0, newYork), 11},
+	} {
+		s := newTestServer(t)
+		clock := &fakeClock{now: tc.start}
+		s.Clock = clock
+		r := setupRouter(s)
+		r.POST("/generate-license", s.GenerateLicense)
+		r.PATCH("/licenses/:key", s.UpdateLicenseTerms)
+
+		license := newLicense(t, r, TIME_BOUND, 2)
+		assert.Equal(t, 48*time.Hour, license.ExpiryDate.Sub(tc.start), tc.start)
+		assert.Equal(t, tc.expiryHour, license.ExpiryDate.In(newYork).Hour(), tc.start)
+
+		// Extending a stored license counts the same way
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("PATCH", "/licenses/"+license.Key.String(), LicenseUpdate{ExtendDays: 1}))
+		assert.Equal(t, http.StatusOK, w.Code)
+		json.Unmarshal(w.Body.Bytes(), &license)
+		assert.Equal(t, 72*time.Hour, license.ExpiryDate.Sub(tc.start), tc.start)
+
+		clock.Advance(72*time.Hour - time.Nanosecond)
+		_, err := s.ValidateLicenseKey(DEFAULT_TENANT, license.Key.String(), OP_DECRYPT)
+		assert.NoError(t, err, tc.start)
+		clock.Advance(time.Nanosecond)
+		_, err = s.ValidateLicenseKey(DEFAULT_TENANT, license.Key.String(), OP_DECRYPT)
+		assert.ErrorIs(t, err, ErrLicenseExpired, tc.start)
+
+		// Start dates given in local time as well
+		midnight := time.Date(tc.start.Year(), tc.start.Month(), tc.start.Day()+1, 0, 0, 0, 0, newYork)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: HYBRID, Days: 1, NotBefore: &midnight}))
+		later := License{}
+		json.Unmarshal(w.Body.Bytes(), &later)
+		assert.Equal(t, 24*time.Hour, later.ExpiryDate.Sub(midnight), tc.start)
+	}
+}
+
+func TestExpiryAcrossLeapDays(t *testing.T) {
+	for _, tc := range []struct {
+		start  time.Time
+		days   int
+		expiry time.Time
+	}{
+		{time.Date(2028, 2, 28, 12, 0, 0, 0, time.UTC), 1, time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{time.Date(2028, 2, 28, 12, 0, 0, 0, time.UTC), 2, time.Date(2028, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC), 365, time.Date(2029, 2, 28, 12, 0, 0, 0, time.UTC)},
+		{time.Date(2027, 2, 28, 12, 0, 0, 0, time.UTC), 1, time.Date(2027, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{time.Date(2027, 12, 31, 23, 59, 59, 0, time.UTC), 60, time.Date(2028, 2, 29, 23, 59, 59, 0, time.UTC)},
+	} {
+		s := newTestServer(t)
+		clock := &fakeClock{now: tc.start}
+		s.Clock = clock
+		r := setupRouter(s)
+		r.POST("/generate-license", s.GenerateLicense)
+
+		license := newLicense(t, r, TIME_BOUND, tc.days)
+		assert.Equal(t, tc.expiry, license.ExpiryDate, "%v + %d days", tc.start, tc.days)
+
+		clock.Advance(tc.expiry.Sub(tc.start) - time.Nanosecond)
+		_, err := s.ValidateLicenseKey(DEFAULT_TENANT, license.Key.String(), OP_ENCRYPT)
+		assert.NoError(t, err)
+		clock.Advance(time.Nanosecond)
+		_, err = s.ValidateLicenseKey(DEFAULT_TENANT, license.Key.String(), OP_ENCRYPT)
+		assert.ErrorIs(t, err, ErrLicenseExpired)
+	}
+}
+
+// waitForRotation waits until the job has stopped running and returns it
+func waitForRotation(t *testing.T, s *Server, id string) RotationJob {
+	var job RotationJob
+	assert.Eventually(t, func() bool {
+		job, _ = s.Rotations.GetRotation(id)
+		return job.Status != ROTATION_RUNNING
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestKeyRotation(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.POST("/key-rotations", s.StartKeyRotation)
+	r.GET("/key-rotations/:id", s.GetKeyRotation)
+	r.POST("/key-manager/rotate", s.RotateMasterKey)
+
+	rotated := newLicense(t, r, "time-bound", 30)
+	other := newLicense(t, r, "time-bound", 30)
+
+	contents := map[string][]byte{}
+	encrypt := func(license License, content []byte) string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", content))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		id := w.Header().Get(FILE_ID_HEADER)
+		contents[id] = content
+		return id
+	}
+	first := encrypt(rotated, bytes.Repeat([]byte("first"), 30000))
+	second := encrypt(rotated, []byte{})
+	untouched := encrypt(other, []byte("other license"))
+
+	blob := func(id string) []byte {
+		_, path, _ := s.ResolveFile(DEFAULT_TENANT, id)
+		data, _ := os.ReadFile(path)
+		return data
+	}
+	before := blob(first)
+	record, _ := s.Files.GetFile(DEFAULT_TENANT, first)
+	assert.Equal(t, uint32(1), record.KeyVersion)
+
+	start := func(request RotationRequest) (*httptest.ResponseRecorder, RotationJob) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("POST", "/key-rotations", request))
+		var resp struct{ Rotation RotationJob }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp.Rotation
+	}
+
+	// Rotate the license's files to a new master key
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/key-manager/rotate", nil))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"currentVersion": 2`)
+	w, job := start(RotationRequest{LicenseKey: rotated.Key.String()})
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	assert.Equal(t, uint32(2), job.TargetKeyVersion)
+	assert.Equal(t, 2, job.Total)
+
+	job = waitForRotation(t, s, job.ID)
+	assert.Equal(t, ROTATION_COMPLETED, job.Status)
+	assert.Equal(t, 2, job.Done)
+	assert.Empty(t, job.FailedFiles)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("GET", "/key-rotations/"+job.ID, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status": "completed"`)
+
+	for id, version := range map[string]uint32{first: 2, second: 2, untouched: 1} {
+		record, _ := s.Files.GetFile(DEFAULT_TENANT, id)
+		assert.Equal(t, version, record.KeyVersion, id)
+	}
+	assert.NotEqual(t, before, blob(first))
+	matches, _ := filepath.Glob(filepath.Join(s.Blobs.TenantDir(DEFAULT_TENANT), "*"+ROTATION_SUFFIX))
+	assert.Empty(t, matches)
+
+	// Retire master key version 1: only the other license's file is left
+	w, job = start(RotationRequest{KeyVersion: 1})
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	assert.Equal(t, 1, job.Total)
+	job = waitForRotation(t, s, job.ID)
+	assert.Equal(t, 1, job.Done)
+	record, _ = s.Files.GetFile(DEFAULT_TENANT, untouched)
+	assert.Equal(t, uint32(2), record.KeyVersion)
+
+	// Every file still decrypts to its content
+	for id, content := range contents {
+		license := rotated
+		if id == untouched {
+			license = other
+		}
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, id), nil))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, string(content), w.Body.String())
+	}
+
+	w, _ = start(RotationRequest{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrInvalidRotation.Code)
+	w, _ = start(RotationRequest{LicenseKey: uuid.NewString()})
+	assert.Contains(t, w.Body.String(), ErrLicenseNotFound.Code)
+	version, _ := currentKeyVersion(s.Keys)
+	assert.Equal(t, uint32(2), version)
+}
+
+func TestKeyRotationResumes(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.POST("/key-rotations/:id/resume", s.ResumeKeyRotation)
+
+	license := newLicense(t, r, "time-bound", 30)
+	var ids []string
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", []byte(strconv.Itoa(i))))
+		ids = append(ids, w.Header().Get(FILE_ID_HEADER))
+	}
+	slices.Sort(ids)
+
+	// The third file is damaged, the rotation reports it and carries on
+	_, path, _ := s.ResolveFile(DEFAULT_TENANT, ids[2])
+	os.WriteFile(path, []byte("SLES garbage"), 0600)
+
+	// A job the server was running when it stopped, after the first file
+	s.Keys.Rotate()
+	job := RotationJob{
+		ID:               uuid.NewString(),
+		Tenant:           DEFAULT_TENANT,
+		LicenseKey:       &license.Key,
+		TargetKeyVersion: 2,
+		Status:           ROTATION_RUNNING,
+		Total:            4,
+		Done:             1,
+		Cursor:           ids[0],
+	}
+	s.Rotations.PutRotation(job)
+	assert.NoError(t, s.ResumeRotations())
+
+	job = waitForRotation(t, s, job.ID)
+	assert.Equal(t, ROTATION_COMPLETED, job.Status)
+	assert.Equal(t, 3, job.Done)
+	assert.Equal(t, []string{ids[2]}, job.FailedFiles)
+	assert.Equal(t, ids[3], job.Cursor)
+
+	for i, version := range []uint32{1, 2, 1, 2} {
+		record, _ := s.Files.GetFile(DEFAULT_TENANT, ids[i])
+		assert.Equal(t, version, record.KeyVersion, i)
+	}
+
+	// Only failed jobs can be resumed by hand
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/key-rotations/"+job.ID+"/resume", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), ErrRotationStatus.Code)
+
+	job.Status = ROTATION_FAILED
+	job.Cursor = ids[2]
+	s.Rotations.PutRotation(job)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/key-rotations/"+job.ID+"/resume", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	job = waitForRotation(t, s, job.ID)
+	assert.Equal(t, ROTATION_COMPLETED, job.Status)
+	assert.Equal(t, 4, job.Done)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/key-rotations/"+uuid.NewString()+"/resume", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestKeyManagerMigration(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+	r.POST("/key-rotations", s.StartKeyRotation)
+	r.GET("/key-manager", s.GetKeyManager)
+
+	license := newLicense(t, r, "time-bound", 30)
+	var ids []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", []byte(strconv.Itoa(i))))
+		assert.Equal(t, http.StatusOK, w.Code)
+		ids = append(ids, w.Header().Get(FILE_ID_HEADER))
+	}
+	decrypt := func(i int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, jsonRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, ids[i]), nil))
+		return w
+	}
+
+	// Switch to another key manager, files keep working with the old one
+	previous := s.Keys
+	current := NewFakeKeyManager()
+	s.Config.KeyManager = KEY_MANAGER_VAULT_TRANSIT
+	s.Keys = &MigratingKeyManager{Current: current, Previous: previous, PreviousBackend: KEY_MANAGER_LOCAL}
+	assert.Equal(t, "0", decrypt(0).Body.String())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("GET", "/key-manager", nil))
+	assert.Contains(t, w.Body.String(), `"migratingFrom": "local"`)
+
+	// A rotation re-wraps them with the new key manager
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/key-rotations", RotationRequest{KeyManager: KEY_MANAGER_LOCAL}))
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var resp struct{ Rotation RotationJob }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, 2, resp.Rotation.Total)
+	job := waitForRotation(t, s, resp.Rotation.ID)
+	assert.Equal(t, ROTATION_COMPLETED, job.Status)
+	assert.Equal(t, 2, job.Done)
+
+	// After which the old key manager can go
+	s.Keys = current
+	for i, id := range ids {
+		record, _ := s.Files.GetFile(DEFAULT_TENANT, id)
+		assert.Equal(t, KEY_MANAGER_VAULT_TRANSIT, record.KeyManager)
+		w := decrypt(i)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, strconv.Itoa(i), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/key-rotations", RotationRequest{KeyManager: "hsm"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrInvalidRotation.Code)
+}
+
+func TestKeyRotationStopsWithoutKeyManager(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+
+	license := newLicense(t, r, "time-bound", 30)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", []byte(strconv.Itoa(i))))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	keys := s.Keys.(*FakeKeyManager)
+	keys.Rotate()
+
+	// The files are fine, the job stops without marking them failed
+	keys.Fail(ErrKeyManagerUnavailable.Wrap(io.ErrUnexpectedEOF))
+	job := RotationJob{ID: uuid.NewString(), Tenant: DEFAULT_TENANT, KeyVersion: 1, TargetKeyVersion: 2, Total: 2}
+	assert.NoError(t, s.startRotation(&job))
+	job = waitForRotation(t, s, job.ID)
+	assert.Equal(t, ROTATION_FAILED, job.Status)
+	assert.Contains(t, job.Error, ErrKeyManagerUnavailable.Message)
+	assert.Empty(t, job.FailedFiles)
+	assert.Empty(t, job.Cursor)
+	assert.Equal(t, 0, job.Done)
+
+	// Resuming once it is back rotates every file
+	keys.Fail(nil)
+	assert.NoError(t, s.startRotation(&job))
+	job = waitForRotation(t, s, job.ID)
+	assert.Equal(t, ROTATION_COMPLETED, job.Status)
+	assert.Equal(t, 2, job.Done)
+	assert.Empty(t, job.FailedFiles)
+}
+
+func TestKeyRotationKeepsRegistrations(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+
+	license := newLicense(t, r, "time-bound", 30)
+	encrypt := func() FileRecord {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, encryptRequest(license.Key.String(), "data.bin", []byte("rotated")))
+		record, _ := s.Files.GetFile(DEFAULT_TENANT, w.Header().Get(FILE_ID_HEADER))
+		return record
+	}
+	s.Keys.Rotate()
+
+	// Changes to the registration made while the file was re-encrypted stay
+	record := encrypt()
+	s.Files.UpdateFile(DEFAULT_TENANT, record.ID, func(current *FileRecord) error {
+		current.OriginalName = "renamed"
+		return nil
+	})
+	assert.NoError(t, s.rotateFile(record))
+	stored, _ := s.Files.GetFile(DEFAULT_TENANT, record.ID)
+	assert.Equal(t, uint32(2), stored.KeyVersion)
+	assert.Equal(t, "renamed", stored.OriginalName)
+
+	// A file unregistered meanwhile isn't brought back, whether its blob is
+	// already gone or not
+	for _, removeBlob := range []bool{false, true} {
+		record := encrypt()
+		_, path, _ := s.ResolveFile(DEFAULT_TENANT, record.ID)
+		s.Files.DeleteFile(DEFAULT_TENANT, record.ID)
+		if removeBlob {
+			os.Remove(path)
+		}
+		assert.ErrorIs(t, s.rotateFile(record), ErrFileNotFound)
+		_, err := s.Files.GetFile(DEFAULT_TENANT, record.ID)
+		assert.ErrorIs(t, err, ErrFileNotFound)
+		assert.NoFileExists(t, path)
+	}
+}
+
+func TestBoltStoreRotations(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), DB_FILE))
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err.Error())
+	}
+	defer store.Close()
+
+	key := uuid.New()
+	now := time.Now().UTC().Truncate(time.Second)
+	job := RotationJob{ID: "job", Tenant: "acme", LicenseKey: &key, Status: ROTATION_FAILED, Total: 3, Done: 1, FailedFiles: []string{"a"}, Cursor: "b", CreatedAt: now}
+	assert.NoError(t, store.PutRotation(job))
+	assert.NoError(t, store.PutRotation(RotationJob{ID: "later", Tenant: "acme", CreatedAt: now.Add(time.Second)}))
+
+	stored, err := store.GetRotation("job")
+	assert.NoError(t, err)
+	assert.Equal(t, job, stored)
+	_, err = store.GetRotation("missing")
+	assert.ErrorIs(t, err, ErrRotationNotFound)
+
+	jobs, _ := store.ListRotations()
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, "job", jobs[0].ID)
+}
+
+func TestRangeDecryption(t *testing.T) {
+	key := uuid.New()
+	plain := make([]byte, 3*CHUNK_SIZE+CHUNK_SIZE/2)
+	rand.Read(plain)
+	encPath := encryptToTemp(t, key, plain)
+
+	readRange := func(path string, offset int64, length int64) ([]byte, error) {
+		src, _ := os.Open(path)
+		defer src.Close()
+		encrypted, err := OpenEncryptedFile(testKeys, key, src)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		n, err := encrypted.WriteRange(&out, offset, length)
+		assert.Equal(t, int64(out.Len()), n)
+		return out.Bytes(), err
+	}
+
+	size := int64(len(plain))
+	for _, part := range []byteRange{
+		{0, 1}, {0, size}, {size - 1, 1}, {CHUNK_SIZE - 1, 2},
+		{CHUNK_SIZE, CHUNK_SIZE}, {100, 2*CHUNK_SIZE + 5}, {3 * CHUNK_SIZE, CHUNK_SIZE / 2},
+	} {
+		decrypted, err := readRange(encPath, part.Start, part.Length)
+		assert.NoError(t, err, "%+v", part)
+		assert.Equal(t, plain[part.Start:part.Start+part.Length], decrypted, "%+v", part)
+	}
+	_, err := readRange(encPath, size-1, 2)
+	assert.Error(t, err)
+
+	// Only the frames covering the range are read, a tampered frame
+	// elsewhere goes unnoticed until it is asked for
+	data, _ := os.ReadFile(encPath)
+	data[len(data)-1] ^= 0x01
+	os.WriteFile(encPath, data, 0600)
+	decrypted, err := readRange(encPath, CHUNK_SIZE, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, plain[CHUNK_SIZE:CHUNK_SIZE+10], decrypted)
+	_, err = readRange(encPath, size-10, 10)
+	assert.ErrorIs(t, err, ErrCorruptedFile)
+
+	// Legacy CBC files are seekable as well
+	legacyPlain := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	iv := bytes.Repeat([]byte{0x42}, aes.BlockSize)
+	block, _ := aes.NewCipher(deriveFileKey(key))
+	ciphertext := make([]byte, len(legacyPlain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, legacyPlain)
+	legacyPath := filepath.Join(t.TempDir(), "legacy.enc")
+	os.WriteFile(legacyPath, append(iv, ciphertext...), 0600)
+
+	for _, part := range []byteRange{{0, 5}, {3, 16}, {16, 16}, {20, 100}, {127, 1}} {
+		decrypted, err := readRange(legacyPath, part.Start, part.Length)
+		assert.NoError(t, err, "%+v", part)
+		assert.Equal(t, legacyPlain[part.Start:part.Start+part.Length], decrypted, "%+v", part)
+	}
+}
+
+func TestRequestedRange(t *testing.T) {
+	modified := time.Date(2026, 3, 1, 12, 0, 0, 500, time.UTC)
+	etag := `"file"`
+
+	for _, test := range []struct {
+		rangeHeader string
+		ifRange     string
+		size        int64
+		want        *byteRange
+		err         error
+	}{
+		{"", "", 100, nil, nil},
+		{"bytes=0-9", "", 100, &byteRange{0, 10}, nil},
+		{"bytes=90-", "", 100, &byteRange{90, 10}, nil},
+		{"bytes=90-200", "", 100, &byteRange{90, 10}, nil},
+		{"bytes=-10", "", 100, &byteRange{90, 10}, nil},
+		{"bytes=-200", "", 100, &byteRange{0, 100}, nil},
+		{"bytes=100-", "", 100, nil, ErrRangeNotSatisfiable},
+		{"bytes=-0", "", 100, nil, ErrRangeNotSatisfiable},
+		{"bytes=0-", "", 0, nil, ErrRangeNotSatisfiable},
+		// Unparsable and multiple ranges are ignored
+		{"bytes=9-0", "", 100, nil, nil},
+		{"bytes=a-b", "", 100, nil, nil},
+		{"items=0-9", "", 100, nil, nil},
+		{"bytes=0-1,5-6", "", 100, nil, nil},
+		// If-Range only applies the range while the file is unchanged
+		{"bytes=0-9", `"file"`, 100, &byteRange{0, 10}, nil},
+		{"bytes=0-9", `"other"`, 100, nil, nil},
+		{"bytes=0-9", `W/"file"`, 100, nil, nil},
+		{"bytes=0-9", modified.Format(http.TimeFormat), 100, &byteRange{0, 10}, nil},
+		{"bytes=0-9", modified.Add(time.Hour).Format(http.TimeFormat), 100, nil, nil},
+	} {
+		req, _ := http.NewRequest("GET", "/decrypt-file", nil)
+		req.Header.Set("Range", test.rangeHeader)
+		req.Header.Set("If-Range", test.ifRange)
+
+		got, err := requestedRange(req, test.size, etag, modified)
+		assert.Equal(t, test.want, got, "%+v", test)
+		assert.Equal(t, test.err, err, "%+v", test)
+	}
+}
+
+func TestDecryptFileRanges(t *testing.T) {
+	s := newTestServer(t)
+	r := setupRouter(s)
+	r.POST("/generate-license", s.GenerateLicense)
+	r.POST("/encrypt-file", s.EncryptFile)
+	r.GET("/decrypt-file", s.DecryptFile)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, jsonRequest("POST", "/generate-license", LicenseRequest{Type: HYBRID, Tokens: 10, Bytes: 10 * CHUNK_SIZE}))
+	license := License{}
+	json.Unmarshal(w.Body.Bytes(), &license)
+
+	content := make([]byte, 2*CHUNK_SIZE+100)
+	rand.Read(content)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "video.mp4", content))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	fileID := w.Header().Get(FILE_ID_HEADER)
+
+	decrypt := func(headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/decrypt-file?licensekey=%v&fileid=%v", license.Key, fileID), nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	left := func() (int, int64) {
+		stored, _ := s.Licenses.GetLicense(license.Key)
+		return *stored.TokensLeft, *stored.BytesLeft
+	}
+
+	// Full downloads advertise range support and a validator
+	w = decrypt(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"`+fileID+`"`, etag)
+	assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+	tokens, bytesLeft := left()
+
+	// A range across a frame boundary continues the download, it's charged
+	// for its own bytes only
+	w = decrypt(map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", CHUNK_SIZE-10, CHUNK_SIZE+9)})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, content[CHUNK_SIZE-10:CHUNK_SIZE+10], w.Body.Bytes())
+	assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", CHUNK_SIZE-10, CHUNK_SIZE+9, len(content)), w.Header().Get("Content-Range"))
+	assert.Equal(t, "20", w.Header().Get("Content-Length"))
+	newTokens, newBytesLeft := left()
+	assert.Equal(t, tokens, newTokens)
+	assert.Equal(t, bytesLeft-20, newBytesLeft)
+
+	// Starting at the beginning again is a new download
+	w = decrypt(map[string]string{"Range": "bytes=0-9"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, content[:10], w.Body.Bytes())
+	newTokens, newBytesLeft = left()
+	assert.Equal(t, tokens-1, newTokens)
+	assert.Equal(t, bytesLeft-30, newBytesLeft)
+
+	w = decrypt(map[string]string{"Range": "bytes=-100", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, content[len(content)-100:], w.Body.Bytes())
+
+	// A stale validator gets the whole file
+	w = decrypt(map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, len(content), w.Body.Len())
+
+	// Ranges past the end are refused before anything is spent
+	tokens, bytesLeft = left()
+	w = decrypt(map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(content))})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Contains(t, w.Body.String(), ErrRangeNotSatisfiable.Code)
+	assert.Equal(t, fmt.Sprintf("bytes */%d", len(content)), w.Header().Get("Content-Range"))
+	newTokens, newBytesLeft = left()
+	assert.Equal(t, tokens, newTokens)
+	assert.Equal(t, bytesLeft, newBytesLeft)
+
+	// A range of a file that was never downloaded opens a download
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, encryptRequest(license.Key.String(), "other.mp4", content))
+	assert.Equal(t, http.StatusOK, w.Code)
+	fileID = w.Header().Get(FILE_ID_HEADER)
+	tokens, _ = left()
+	w = decrypt(map[string]string{"Range": "bytes=-100"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	newTokens, _ = left()
+	assert.Equal(t, tokens-1, newTokens)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrInvalidPath = NewAPIError(http.StatusBadRequest, "invalid_path", "Invalid file path")
+
+// SafePath resolves rel below root and returns the real path. Absolute paths,
+// traversal out of root and symlinks pointing outside of it are rejected. The
+// path doesn't have to exist yet, the part that exists is resolved.
+func SafePath(root string, rel string) (string, error) {
+
+	if rel == "" || strings.Contains(rel, `\`) || !filepath.IsLocal(rel) || filepath.Clean(rel) == "." {
+		return "", ErrInvalidPath
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	// Walk up to the deepest part of the path that exists and resolve it
+	resolved, tail := filepath.Join(realRoot, rel), ""
+	for {
+		real, err := filepath.EvalSymlinks(resolved)
+		if err == nil {
+			resolved = filepath.Join(real, tail)
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) || resolved == realRoot {
+			return "", err
+		}
+		// A symlink pointing nowhere would be followed once the file is created
+		if _, err := os.Lstat(resolved); err == nil {
+			return "", ErrInvalidPath
+		}
+		tail = filepath.Join(filepath.Base(resolved), tail)
+		resolved = filepath.Dir(resolved)
+	}
+
+	inside, err := filepath.Rel(realRoot, resolved)
+	if err != nil || !filepath.IsLocal(inside) {
+		return "", ErrInvalidPath
+	}
+	return resolved, nil
+}
+
+// validFileID reports whether id can name a file. Ids are generated by the
+// server, older files use their name.
+func validFileID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && filepath.IsLocal(id)
+}
+
+// BlobStorage keeps the encrypted data of files below its root directory.
+// Blobs are named by paths relative to the root and resolved with SafePath, so
+// nothing outside of it is ever read or written.
+type BlobStorage struct {
+	Root string
+}
+
+// NewBlobStorage returns the storage below root, creating root if needed.
+func NewBlobStorage(root string) (*BlobStorage, error) {
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &BlobStorage{Root: root}, nil
+}
+
+// Path returns the real path of the blob.
+func (b *BlobStorage) Path(rel string) (string, error) {
+	return SafePath(b.Root, rel)
+}
+
+// Create creates the blob for writing, never through an existing file or link.
+func (b *BlobStorage) Create(rel string) (*os.File, error) {
+
+	path, err := b.Path(rel)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// TenantDir returns the directory holding the tenant's encrypted files.
+func (b *BlobStorage) TenantDir(tenant string) string {
+	return filepath.Join(b.Root, "tenants", tenant)
+}
+
+// ResolveFile looks up a registered file of the tenant and returns it with the
+// path of its encrypted data. Every handler reading encrypted files goes
+// through here, so only registered files inside the blob storage are ever
+// opened.
+func (s *Server) ResolveFile(tenant string, id string) (FileRecord, string, error) {
+
+	if !validFileID(id) {
+		return FileRecord{}, "", ErrInvalidPath.WithDetails(gin.H{"fileid": id})
+	}
+
+	record, err := s.Files.GetFile(tenant, id)
+	if err != nil {
+		return record, "", err
+	}
+
+	path, err := s.Blobs.Path(record.Path)
+	return record, path, err
+}
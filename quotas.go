@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Bytes reserved from the budget at a time once a stream outgrows the size
+// expected up front.
+const METER_GRANT = 1 << 20
+
+var ErrQuotaExceeded = NewAPIError(http.StatusForbidden, "quota_exceeded", "Byte quota of the license exhausted")
+
+// UsageRecord is the plaintext volume one encryption or decryption consumed.
+// Complete is false for decryptions aborted while streaming.
+type UsageRecord struct {
+	LicenseKey  uuid.UUID `json:"licenseKey"`
+	Tenant      string    `json:"tenant"`
+	Operation   string    `json:"operation"`
+	FileID      string    `json:"fileId"`
+	Bytes       int64     `json:"bytes"`
+	Complete    bool      `json:"complete"`
+	RequestedBy string    `json:"requestedBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// licenseMeter charges streamed bytes to the byte budget of a license. Bytes
+// are reserved from the store in grants, so concurrent streams can't overdraw
+// the budget, and whatever wasn't streamed is returned by settle.
+type licenseMeter struct {
+	licenses LicenseStore
+	log      logrus.FieldLogger
+	key      uuid.UUID
+	limited  bool
+	granted  int64
+	used     int64
+}
+
+// newLicenseMeter returns a meter for the license, reserving the expected size
+// up front. Streams that can't fit into the budget are refused before the
+// first byte is processed.
+func (s *Server) newLicenseMeter(license License, expected int64) (*licenseMeter, error) {
+
+	meter := &licenseMeter{licenses: s.Licenses, log: s.Log, key: license.Key, limited: license.BytesLeft != nil}
+	if !meter.limited || expected <= 0 {
+		return meter, nil
+	}
+
+	granted, err := meter.reserve(expected)
+	meter.granted = granted
+	if err == nil && granted < expected {
+		err = ErrQuotaExceeded.WithDetails(gin.H{"bytesLeft": granted, "required": expected})
+	}
+	if err != nil {
+		meter.settle(false)
+		return nil, err
+	}
+	return meter, nil
+}
+
+func (m *licenseMeter) Charge(n int64) error {
+
+	if m.limited && m.used+n > m.granted {
+		granted, err := m.reserve(max(m.used+n-m.granted, METER_GRANT))
+		m.granted += granted
+		if err != nil {
+			return err
+		}
+		if m.used+n > m.granted {
+			return ErrQuotaExceeded
+		}
+	}
+	m.used += n
+	return nil
+}
+
+// settle returns the unused part of the reservation to the budget and the
+// bytes charged. Without keep nothing is charged, for operations that failed.
+func (m *licenseMeter) settle(keep bool) int64 {
+
+	if !keep {
+		m.used = 0
+	}
+	if unused := m.granted - m.used; m.limited && unused > 0 {
+		_, err := m.licenses.UpdateLicense(m.key, func(license *License) error {
+			if license.BytesLeft != nil {
+				license.BytesLeft = budget(*license.BytesLeft + unused)
+			}
+			return nil
+		})
+		if err != nil {
+			m.log.WithError(err).Warn("Unable to return unused bytes to license ", m.key)
+		}
+		m.granted = m.used
+	}
+	return m.used
+}
+
+// reserve takes up to n bytes from the byte budget of the license and returns
+// how many it got.
+func (m *licenseMeter) reserve(n int64) (int64, error) {
+
+	var granted int64
+	_, err := m.licenses.UpdateLicense(m.key, func(license *License) error {
+		if license.BytesLeft == nil {
+			granted = n
+			return nil
+		}
+		if *license.BytesLeft <= 0 {
+			return ErrQuotaExceeded
+		}
+		granted = min(n, *license.BytesLeft)
+		license.BytesLeft = budget(*license.BytesLeft - granted)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return granted, nil
+}
+
+// recordUsage logs the bytes an operation consumed. Failing to log doesn't
+// fail the operation, it has already been served.
+func (s *Server) recordUsage(c *gin.Context, license License, operation string, fileID string, bytes int64, complete bool) {
+
+	record := UsageRecord{
+		LicenseKey:  license.Key,
+		Tenant:      license.Tenant,
+		Operation:   operation,
+		FileID:      fileID,
+		Bytes:       bytes,
+		Complete:    complete,
+		RequestedBy: requestedBy(c),
+		CreatedAt:   s.Clock.Now(),
+	}
+	if err := s.Usage.RecordUsage(record); err != nil {
+		s.Log.WithError(err).Error("Unable to record usage of license ", license.Key)
+	}
+}
+
+// downloadedBefore reports whether the license decrypted the file before, so
+// a range of it continues a download that was already charged.
+func (s *Server) downloadedBefore(license License, fileID string) bool {
+
+	usage, err := s.Usage.ListUsage(license.Key)
+	if err != nil {
+		s.Log.WithError(err).Warn("Unable to read usage of license ", license.Key)
+		return false
+	}
+	for i := len(usage) - 1; i >= 0; i-- {
+		if usage[i].Operation == OP_DECRYPT && usage[i].FileID == fileID {
+			return true
+		}
+	}
+	return false
+}
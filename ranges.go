@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRangeNotSatisfiable = NewAPIError(http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", "The requested range is outside of the file")
+
+// byteRange is a part of a file, Length bytes from Start.
+type byteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats the Content-Range header of the part of a file of size
+// bytes.
+func (r byteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// requestedRange returns the part of a file of size bytes the request asks
+// for with its Range header, or nil if the whole file is to be sent. Range
+// headers that can't be parsed, ask for several ranges or carry an If-Range
+// that no longer matches the file are ignored, as HTTP allows. A range that
+// starts after the end of the file is answered with ErrRangeNotSatisfiable.
+func requestedRange(req *http.Request, size int64, etag string, modified time.Time) (*byteRange, error) {
+
+	header := req.Header.Get("Range")
+	if header == "" || !ifRangeMatches(req.Header.Get("If-Range"), etag, modified) {
+		return nil, nil
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return nil, nil
+	}
+
+	if first == "" {
+		// Suffix range: the last bytes of the file
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return nil, nil
+		}
+		if suffix == 0 || size == 0 {
+			return nil, ErrRangeNotSatisfiable
+		}
+		suffix = min(suffix, size)
+		return &byteRange{Start: size - suffix, Length: suffix}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return nil, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return nil, ErrRangeNotSatisfiable
+	}
+	return &byteRange{Start: start, Length: end - start + 1}, nil
+}
+
+// ifRangeMatches reports whether the If-Range validator, if any, still
+// matches the file. Only strong entity tags and exact dates match.
+func ifRangeMatches(ifRange string, etag string, modified time.Time) bool {
+
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`):
+		return ifRange == etag
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	}
+	date, err := http.ParseTime(ifRange)
+	return err == nil && !modified.IsZero() && date.Equal(modified.Truncate(time.Second))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RATE_LIMIT_HEADER = "X-RateLimit-Limit"
+const RATE_REMAINING_HEADER = "X-RateLimit-Remaining"
+const RATE_RESET_HEADER = "X-RateLimit-Reset"
+
+var ErrRateLimited = NewAPIError(http.StatusTooManyRequests, "rate_limited", "Rate limit of the license exceeded. Please retry later")
+var ErrInvalidRateLimit = NewAPIError(http.StatusBadRequest, "invalid_rate_limit", "Rate limits need an operation of 'encrypt', 'decrypt' or none, a window of at least a second and either maxRequests or maxBytes")
+
+// RateLimit caps how often, or how many bytes, a license may be used for an
+// operation within a rolling window, e.g. 10 decryptions per hour. Limits
+// without an operation count encryptions and decryptions together.
+type RateLimit struct {
+	Operation   string   `json:"operation,omitempty"`
+	Window      Duration `json:"window" swaggertype:"string" example:"1h"`
+	MaxRequests int64    `json:"maxRequests,omitempty"`
+	MaxBytes    int64    `json:"maxBytes,omitempty"`
+}
+
+// Name identifies the counter of the limit, e.g. "decrypt/1h0m0s/requests".
+func (l RateLimit) Name() string {
+	operation, unit := l.Operation, "requests"
+	if operation == "" {
+		operation = "any"
+	}
+	if l.MaxBytes > 0 {
+		unit = "bytes"
+	}
+	return fmt.Sprintf("%s/%s/%s", operation, l.Window.Duration, unit)
+}
+
+func (l RateLimit) max() int64 {
+	if l.MaxBytes > 0 {
+		return l.MaxBytes
+	}
+	return l.MaxRequests
+}
+
+func (l RateLimit) appliesTo(operation string) bool {
+	return l.Operation == "" || l.Operation == operation
+}
+
+func validRateLimit(limit RateLimit) bool {
+	validOperation := limit.Operation == "" || limit.Operation == OP_ENCRYPT || limit.Operation == OP_DECRYPT
+	oneMax := (limit.MaxRequests > 0) != (limit.MaxBytes > 0) && limit.MaxRequests >= 0 && limit.MaxBytes >= 0
+	return validOperation && oneMax && limit.Window.Duration >= time.Second
+}
+
+// RateCounter approximates a sliding window with two fixed ones: the usage of
+// the previous window is weighted by how much of it still overlaps the
+// sliding window. Windows are aligned to multiples of their length.
+type RateCounter struct {
+	Start    time.Time `json:"start"`
+	Current  int64     `json:"current"`
+	Previous int64     `json:"previous"`
+}
+
+// roll moves the counter to the window containing now.
+func (r *RateCounter) roll(window time.Duration, now time.Time) {
+
+	start := now.Truncate(window)
+	switch {
+	case start.Equal(r.Start):
+	case start.Equal(r.Start.Add(window)):
+		r.Previous, r.Current = r.Current, 0
+	default:
+		r.Previous, r.Current = 0, 0
+	}
+	r.Start = start
+}
+
+func (r RateCounter) estimate(window time.Duration, now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(r.Start))/float64(window)
+	return float64(r.Previous)*overlap + float64(r.Current)
+}
+
+// retryAfter returns how long until cost more fits below max. The usage of
+// the current window only starts to fade once it became the previous one.
+func (r RateCounter) retryAfter(window time.Duration, max int64, cost int64, now time.Time) time.Duration {
+
+	if r.Current+cost <= max && r.Previous > 0 {
+		fraction := 1 - float64(max-cost-r.Current)/float64(r.Previous)
+		return r.Start.Add(time.Duration(fraction * float64(window))).Sub(now)
+	}
+	fraction := 1 - float64(max-cost)/float64(r.Current)
+	return r.Start.Add(window + time.Duration(fraction*float64(window))).Sub(now)
+}
+
+// RateStatus describes the limit closest to being exhausted after a request.
+type RateStatus struct {
+	Limit     RateLimit
+	Remaining int64
+	Reset     time.Duration
+}
+
+// AcquireRate counts the operation, bytes long, against every limit applying
+// to it, or returns ErrRateLimited without counting anything if one of them
+// doesn't allow it. The stores call it while holding the counters of the
+// license.
+func AcquireRate(counters map[string]RateCounter, limits []RateLimit, operation string, bytes int64, now time.Time) (*RateStatus, error) {
+
+	var status *RateStatus
+	tightest := math.Inf(1)
+
+	for _, limit := range limits {
+		if !limit.appliesTo(operation) {
+			continue
+		}
+		window := limit.Window.Duration
+		counter := counters[limit.Name()]
+		counter.roll(window, now)
+
+		cost := int64(1)
+		if limit.MaxBytes > 0 {
+			cost = bytes
+		}
+		used := counter.estimate(window, now)
+		if used+float64(cost) > float64(limit.max()) {
+			details := gin.H{"limit": limit.Name()}
+			// A single operation larger than the limit never fits
+			if cost <= limit.max() {
+				details["retryAfter"] = int64(math.Ceil(counter.retryAfter(window, limit.max(), cost, now).Seconds()))
+			}
+			return &RateStatus{Limit: limit, Remaining: 0, Reset: counter.Start.Add(window).Sub(now)}, ErrRateLimited.WithDetails(details)
+		}
+
+		remaining := limit.max() - int64(math.Ceil(used)) - cost
+		if share := float64(remaining) / float64(limit.max()); share < tightest {
+			tightest = share
+			status = &RateStatus{Limit: limit, Remaining: max(remaining, 0), Reset: counter.Start.Add(window).Sub(now)}
+		}
+	}
+
+	// Only count once every limit allowed the operation
+	for _, limit := range limits {
+		if !limit.appliesTo(operation) {
+			continue
+		}
+		counter := counters[limit.Name()]
+		counter.roll(limit.Window.Duration, now)
+		if limit.MaxBytes > 0 {
+			counter.Current += bytes
+		} else {
+			counter.Current++
+		}
+		counters[limit.Name()] = counter
+	}
+	return status, nil
+}
+
+// acquireLicenseRate applies the rate limits of the license to the request and
+// reports the tightest of them in the X-RateLimit-* headers.
+func (s *Server) acquireLicenseRate(c *gin.Context, license License, operation string, bytes int64) error {
+
+	if len(license.RateLimits) == 0 {
+		return nil
+	}
+
+	status, err := s.Rates.AcquireRate(license.Key, license.RateLimits, operation, bytes, s.Clock.Now())
+	if status != nil {
+		c.Header(RATE_LIMIT_HEADER, strconv.FormatInt(status.Limit.max(), 10))
+		c.Header(RATE_REMAINING_HEADER, strconv.FormatInt(status.Remaining, 10))
+		c.Header(RATE_RESET_HEADER, strconv.FormatInt(int64(math.Ceil(status.Reset.Seconds())), 10))
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		if details, ok := apiErr.Details.(gin.H); ok && details["retryAfter"] != nil {
+			c.Header("Retry-After", fmt.Sprint(details["retryAfter"]))
+		}
+	}
+	return err
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const ROTATION_RUNNING = "running"
+const ROTATION_COMPLETED = "completed"
+const ROTATION_FAILED = "failed"
+
+// Suffix of the blob a file is re-encrypted into before it replaces the file
+const ROTATION_SUFFIX = ".rotating"
+
+var ErrRotationNotFound = NewAPIError(http.StatusNotFound, "rotation_not_found", "Key rotation doesn't exist")
+var ErrRotationRunning = NewAPIError(http.StatusConflict, "rotation_running", "A key rotation is already running for the tenant")
+var ErrRotationStatus = NewAPIError(http.StatusConflict, "rotation_status_conflict", "Only failed key rotations can be resumed")
+var ErrInvalidRotation = NewAPIError(http.StatusBadRequest, "invalid_rotation", "Select the files to rotate with any of 'licenseKey', 'keyVersion' and 'keyManager'")
+
+// RotationJob re-encrypts the files of a tenant with new data keys wrapped
+// under the current master key version. It selects the files of a license,
+// the files wrapped under a master key version or older, the files wrapped
+// by a key manager, or the intersection of those. Files are processed in id order and the job is stored after each
+// one, so an interrupted job resumes after Cursor.
+type RotationJob struct {
+	ID         string     `json:"id"`
+	Tenant     string     `json:"tenant"`
+	LicenseKey *uuid.UUID `json:"licenseKey,omitempty"`
+	KeyVersion uint32     `json:"keyVersion,omitempty"`
+	KeyManager string     `json:"keyManager,omitempty"`
+	// Current master key version when the job was started
+	TargetKeyVersion uint32 `json:"targetKeyVersion"`
+	Status           string `json:"status"`
+	Total            int    `json:"total"`
+	Done             int    `json:"done"`
+	// Files that couldn't be re-encrypted, they keep their old key
+	FailedFiles []string  `json:"failedFiles,omitempty"`
+	Cursor      string    `json:"cursor,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Selects reports whether the job re-encrypts the file. Files without a
+// recorded key version count as older than any version.
+func (job RotationJob) Selects(record FileRecord) bool {
+
+	if record.Tenant != job.Tenant {
+		return false
+	}
+	if job.LicenseKey != nil && record.LicenseKey != *job.LicenseKey {
+		return false
+	}
+	if job.KeyManager != "" && record.KeyManager != job.KeyManager {
+		return false
+	}
+	return job.KeyVersion == 0 || record.KeyVersion <= job.KeyVersion
+}
+
+type RotationRequest struct {
+	LicenseKey string `json:"licenseKey"`
+	KeyVersion uint32 `json:"keyVersion"`
+	// Selects the files wrapped by this key manager, to move them to the
+	// current one
+	KeyManager string `json:"keyManager"`
+}
+
+// startRotation runs the job in the background. A tenant has at most one
+// running job, so no file is re-encrypted twice at the same time.
+func (s *Server) startRotation(job *RotationJob) error {
+
+	s.rotatingMu.Lock()
+	defer s.rotatingMu.Unlock()
+
+	if running, found := s.rotating[job.Tenant]; found {
+		return ErrRotationRunning.WithDetails(gin.H{"id": running})
+	}
+
+	job.Status = ROTATION_RUNNING
+	job.Error = ""
+	job.UpdatedAt = s.Clock.Now()
+	if err := s.Rotations.PutRotation(*job); err != nil {
+		return err
+	}
+
+	s.rotating[job.Tenant] = job.ID
+	go s.runRotation(*job)
+	return nil
+}
+
+func (s *Server) runRotation(job RotationJob) {
+
+	log := s.Log.WithFields(logrus.Fields{"rotation": job.ID, "tenant": job.Tenant})
+	defer func() {
+		s.rotatingMu.Lock()
+		delete(s.rotating, job.Tenant)
+		s.rotatingMu.Unlock()
+	}()
+
+	err := s.rotateFiles(&job, log)
+
+	job.Status = ROTATION_COMPLETED
+	if err != nil {
+		job.Status = ROTATION_FAILED
+		job.Error = err.Error()
+		log.Error("Key rotation stopped. Error: ", err.Error())
+	}
+	job.UpdatedAt = s.Clock.Now()
+	if err := s.Rotations.PutRotation(job); err != nil {
+		log.Error("Unable to store the key rotation. Error: ", err.Error())
+		return
+	}
+	log.Infof("Key rotation %s, %d of %d files re-encrypted", job.Status, job.Done, job.Total)
+}
+
+// rotateFiles re-encrypts the selected files after the cursor, storing the
+// progress after each file. Damaged files are recorded and skipped. Any other
+// error, like an unavailable key manager or store, stops the job before the
+// file, so resuming it retries the file.
+func (s *Server) rotateFiles(job *RotationJob, log logrus.FieldLogger) error {
+
+	files, err := s.Files.ListFiles(job.Tenant)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range files {
+		if record.ID <= job.Cursor || !job.Selects(record) {
+			continue
+		}
+
+		err := s.rotateFile(record)
+		switch {
+		case errors.Is(err, ErrFileNotFound):
+			// Deleted or rolled back since the job started
+			log.Info("Skipping file ", record.ID, ", it is no longer registered")
+			job.Total -= 1
+		case fileDamaged(err):
+			log.Error("Unable to re-encrypt file ", record.ID, ". Error: ", err.Error())
+			job.FailedFiles = append(job.FailedFiles, record.ID)
+		case err != nil:
+			return err
+		default:
+			job.Done += 1
+		}
+
+		job.Cursor = record.ID
+		job.UpdatedAt = s.Clock.Now()
+		if err := s.Rotations.PutRotation(*job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileDamaged reports whether a file couldn't be rotated because of the file
+// itself, its blob is missing, unreadable as an encrypted file or its key
+// doesn't unwrap. Retrying won't help those.
+func fileDamaged(err error) bool {
+	return errors.Is(err, ErrCorruptedFile) || errors.Is(err, ErrUnsupportedFormat) ||
+		errors.Is(err, ErrKeyUnwrap) || errors.Is(err, fs.ErrNotExist)
+}
+
+// rotateFile re-encrypts the file with a new data key wrapped under the
+// current master key version. The plaintext is piped from decryption into
+// encryption and never written to disk. The new blob is renamed over the old
+// one, so readers see either the old or the new file. ErrFileNotFound means
+// the file was unregistered meanwhile.
+func (s *Server) rotateFile(record FileRecord) error {
+
+	path, err := s.Blobs.Path(record.Path)
+	if err != nil {
+		return err
+	}
+	srcFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, getErr := s.Files.GetFile(record.Tenant, record.ID); errors.Is(getErr, ErrFileNotFound) {
+			return getErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	encrypted, err := OpenEncryptedFile(s.Keys, record.LicenseKey, srcFile)
+	if err != nil {
+		return err
+	}
+
+	// A blob left by an interrupted rotation is replaced
+	tempPath := record.Path + ROTATION_SUFFIX
+	if stale, err := s.Blobs.Path(tempPath); err == nil {
+		os.Remove(stale)
+	}
+	destFile, err := s.Blobs.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := encrypted.WriteTo(writer)
+		writer.CloseWithError(err)
+	}()
+	version, err := encryptStream(s.Keys, record.LicenseKey, encrypted.Size(), reader, destFile, nil)
+	// Stops the decryption if encryption gave up early
+	reader.Close()
+
+	if err == nil {
+		err = destFile.Sync()
+	}
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(destFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(destFile.Name())
+		return err
+	}
+
+	// Only the key version changes, the registration is re-read so a file
+	// unregistered meanwhile isn't brought back
+	_, err = s.Files.UpdateFile(record.Tenant, record.ID, func(current *FileRecord) error {
+		current.KeyVersion = version
+		current.KeyManager = s.Config.KeyManager
+		return nil
+	})
+	if errors.Is(err, ErrFileNotFound) {
+		os.Remove(path)
+	}
+	return err
+}
+
+// ResumeRotations restarts the jobs that were running when the server
+// stopped.
+func (s *Server) ResumeRotations() error {
+
+	jobs, err := s.Rotations.ListRotations()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Status != ROTATION_RUNNING {
+			continue
+		}
+		s.Log.Info("Resuming key rotation ", job.ID)
+		if err := s.startRotation(&job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantRotation returns the caller's rotation job named by the id path
+// parameter.
+func (s *Server) tenantRotation(c *gin.Context) (RotationJob, error) {
+
+	job, err := s.Rotations.GetRotation(c.Param("id"))
+	if err == nil && job.Tenant != callerTenant(c) {
+		err = ErrRotationNotFound
+	}
+	return job, err
+}
+
+// @Summary Start a key rotation
+// @Description Re-encrypt the files of a license ('licenseKey'), the files wrapped under a master key version or older ('keyVersion'), the files wrapped by a key manager ('keyManager'), or the files matching all of those given, with new data keys under the current master key version of the current key manager. New master key versions are added by operators with POST /key-manager/rotate. The job runs in the background, its progress is reported by GET /key-rotations/{id}.
+// @Accept json
+// @Produce json
+// @Param Request body RotationRequest true "Files to rotate"
+// @Success 202
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/key-rotations [post]
+func (s *Server) StartKeyRotation(c *gin.Context) {
+	var reqBody RotationRequest
+
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		abortWithError(c, BindError(err))
+		return
+	}
+
+	if reqBody.LicenseKey == "" && reqBody.KeyVersion == 0 && reqBody.KeyManager == "" {
+		abortWithError(c, ErrInvalidRotation)
+		return
+	}
+	if reqBody.KeyManager != "" && reqBody.KeyManager != KEY_MANAGER_LOCAL && reqBody.KeyManager != KEY_MANAGER_VAULT_TRANSIT {
+		abortWithError(c, ErrInvalidRotation.WithDetails(gin.H{"keyManager": reqBody.KeyManager}))
+		return
+	}
+
+	tenant := callerTenant(c)
+	now := s.Clock.Now()
+	job := RotationJob{
+		ID:         uuid.NewString(),
+		Tenant:     tenant,
+		KeyVersion: reqBody.KeyVersion,
+		KeyManager: reqBody.KeyManager,
+		CreatedBy:  requestedBy(c),
+		CreatedAt:  now,
+	}
+
+	if reqBody.LicenseKey != "" {
+		key, err := s.ParseLicenseKey(reqBody.LicenseKey)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		license, err := s.Licenses.GetLicense(key)
+		if err == nil && license.Tenant != tenant {
+			err = ErrLicenseNotFound
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		job.LicenseKey = &key
+	}
+
+	target, err := currentKeyVersion(s.Keys)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	job.TargetKeyVersion = target
+
+	files, err := s.Files.ListFiles(tenant)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	for _, record := range files {
+		if job.Selects(record) {
+			job.Total += 1
+		}
+	}
+
+	if err := s.startRotation(&job); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("Key rotation started. Rotation id: ", job.ID)
+	c.IndentedJSON(http.StatusAccepted, gin.H{"message": "Key rotation started", "rotation": job})
+
+}
+
+// @Summary List key rotations
+// @Description Get the key rotation jobs of the tenant with their progress.
+// @Produce json
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/key-rotations [get]
+func (s *Server) GetKeyRotations(c *gin.Context) {
+
+	jobs, err := s.Rotations.ListRotations()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	tenant := callerTenant(c)
+	tenantJobs := []RotationJob{}
+	for _, job := range jobs {
+		if job.Tenant == tenant {
+			tenantJobs = append(tenantJobs, job)
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, tenantJobs)
+
+}
+
+// @Summary Get a key rotation
+// @Description Get the status and progress of a key rotation job.
+// @Produce json
+// @Param id path string true "Rotation id"
+// @Success 200
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/key-rotations/{id} [get]
+func (s *Server) GetKeyRotation(c *gin.Context) {
+
+	job, err := s.tenantRotation(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, job)
+
+}
+
+// @Summary Resume a key rotation
+// @Description Continue a failed key rotation job after the last file it processed. Jobs interrupted by a restart are resumed automatically.
+// @Produce json
+// @Param id path string true "Rotation id"
+// @Success 202
+// @Security ApiKeyAuth
+// @Router /sles/api/v1/key-rotations/{id}/resume [post]
+func (s *Server) ResumeKeyRotation(c *gin.Context) {
+
+	job, err := s.tenantRotation(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if job.Status != ROTATION_FAILED {
+		abortWithError(c, ErrRotationStatus.WithDetails(gin.H{"status": job.Status}))
+		return
+	}
+
+	if err := s.startRotation(&job); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Log.Info("Key rotation resumed. Rotation id: ", job.ID)
+	c.IndentedJSON(http.StatusAccepted, gin.H{"message": "Key rotation resumed", "rotation": job})
+
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Operations a license can be scoped to, besides OP_ENCRYPT and OP_DECRYPT
+const OP_SHARE_LINK = "share-link"
+
+var ErrScopeDenied = NewAPIError(http.StatusForbidden, "scope_denied", "The license doesn't allow this")
+var ErrInvalidScopes = NewAPIError(http.StatusBadRequest, "invalid_scopes", "Scopes need operations out of 'encrypt', 'decrypt' and 'share-link', MIME types like 'image/*' and valid file ids")
+
+// LicenseScopes restrict what a license can be used for. Licenses without
+// scopes can do everything. Without FileIDs a license can only decrypt and
+// share the files it encrypted; with them it can only decrypt and share the
+// listed files of its tenant, whichever license encrypted them. That way
+// publishers encrypt with encrypt-only licenses and sell decrypt-only ones.
+type LicenseScopes struct {
+	Operations  []string `json:"operations"`
+	MaxFileSize int64    `json:"maxFileSize,omitempty"`
+	MimeTypes   []string `json:"mimeTypes,omitempty"`
+	FileIDs     []string `json:"fileIds,omitempty"`
+}
+
+func validScopes(scopes LicenseScopes) bool {
+
+	if len(scopes.Operations) == 0 || scopes.MaxFileSize < 0 {
+		return false
+	}
+	for _, operation := range scopes.Operations {
+		if operation != OP_ENCRYPT && operation != OP_DECRYPT && operation != OP_SHARE_LINK {
+			return false
+		}
+	}
+	for _, pattern := range scopes.MimeTypes {
+		if _, err := path.Match(pattern, "type/subtype"); err != nil || strings.Count(pattern, "/") != 1 {
+			return false
+		}
+	}
+	return !slices.ContainsFunc(scopes.FileIDs, func(id string) bool { return !validFileID(id) })
+}
+
+// AllowsOperation checks the license is scoped to the operation.
+func (l License) AllowsOperation(operation string) error {
+
+	if l.Scopes != nil && !slices.Contains(l.Scopes.Operations, operation) {
+		return ErrScopeDenied.WithDetails(gin.H{"operation": operation})
+	}
+	return nil
+}
+
+// AllowsFile checks the license may decrypt or share the file. Files it has
+// no access to are answered like files with a wrong key, so callers can't
+// probe which ids exist.
+func (l License) AllowsFile(record FileRecord) error {
+
+	if l.Scopes != nil && len(l.Scopes.FileIDs) > 0 {
+		if !slices.Contains(l.Scopes.FileIDs, record.ID) {
+			return ErrIncorrectKey
+		}
+	} else if record.LicenseKey != l.Key {
+		return ErrIncorrectKey
+	}
+	return l.AllowsContent(-1, record.ContentType)
+}
+
+// AllowsContent checks the size and MIME type of a file against the scopes.
+// A negative size isn't checked.
+func (l License) AllowsContent(size int64, contentType string) error {
+
+	if l.Scopes == nil {
+		return nil
+	}
+	if l.Scopes.MaxFileSize > 0 && size > l.Scopes.MaxFileSize {
+		return ErrScopeDenied.WithDetails(gin.H{"maxFileSize": l.Scopes.MaxFileSize, "size": size})
+	}
+	if len(l.Scopes.MimeTypes) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	for _, pattern := range l.Scopes.MimeTypes {
+		if matched, _ := path.Match(pattern, mediaType); matched {
+			return nil
+		}
+	}
+	return ErrScopeDenied.WithDetails(gin.H{"mimeTypes": l.Scopes.MimeTypes, "contentType": mediaType})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+)
+
+// Server holds everything the handlers depend on. main and the tests build it
+// with NewServer, so each server has its own stores, storage, keys and clock.
+type Server struct {
+	Config    Config
+	Licenses  LicenseStore
+	Files     FileRegistry
+	Links     LinkRegistry
+	Rates     RateCounters
+	Usage     UsageLog
+	Rotations RotationJobs
+	Blobs     *BlobStorage
+	Keys      KeyManager
+	// Derived from the master secret, see LoadMasterSecret
+	LinkSigningKey    []byte
+	LicenseSigningKey ed25519.PrivateKey
+	Clock             Clock
+	Log               *logrus.Logger
+
+	// Tenants with a running rotation job, and its id
+	rotatingMu sync.Mutex
+	rotating   map[string]string
+}
+
+// NewServer returns a server for the configuration, keeping its records in
+// store, the encrypted files in the storage directory of cfg and wrapping
+// their keys with keys. Links and license tokens are signed with keys derived
+// from secret.
+func NewServer(cfg Config, store Store, keys KeyManager, secret []byte, log *logrus.Logger) (*Server, error) {
+
+	blobs, err := NewBlobStorage(cfg.StorageDir)
+	if err != nil {
+		return nil, err
+	}
+	linkKey, err := deriveLinkSigningKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	licenseKey, err := deriveLicenseSigningKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		Config:            cfg,
+		Licenses:          store,
+		Files:             store,
+		Links:             store,
+		Rates:             store,
+		Usage:             store,
+		Rotations:         store,
+		Blobs:             blobs,
+		Keys:              keys,
+		LinkSigningKey:    linkKey,
+		LicenseSigningKey: licenseKey,
+		Clock:             systemClock{},
+		Log:               log,
+		rotating:          map[string]string{},
+	}, nil
+}
+
+// Router registers the routes. Everything except secure links, the license
+// token keys and the API docs needs one of the configured credentials, with
+// the role the route allows.
+func (s *Server) Router() *gin.Engine {
+
+	router := gin.Default()
+	router.Use(ErrorHandler(s.Log))
+
+	admin := RequireRole(ROLE_ADMIN)
+	issuer := RequireRole(ROLE_ADMIN, ROLE_ISSUER)
+	consumer := RequireRole(ROLE_ADMIN, ROLE_CONSUMER)
+	operator := RequireRole(ROLE_OPERATOR)
+
+	api := router.Group("/sles/api/v1", Authenticate(s.Config.Credentials))
+	api.GET("/fetch-license", admin, s.GetLicense)
+	api.POST("/generate-license", issuer, s.GenerateLicense)
+	api.GET("/licenses/:key", issuer, s.GetLicenseDetails)
+	api.PATCH("/licenses/:key", issuer, s.UpdateLicenseTerms)
+	api.GET("/licenses/:key/usage", issuer, s.GetLicenseUsage)
+	api.POST("/licenses/:key/suspend", issuer, s.SuspendLicense)
+	api.POST("/licenses/:key/resume", issuer, s.ResumeLicense)
+	api.POST("/licenses/:key/revoke", issuer, s.RevokeLicense)
+	api.DELETE("/licenses/:key", issuer, s.DeleteLicense)
+	api.POST("/encrypt-file", consumer, s.EncryptFile)
+	api.GET("/encrypt-file", admin, s.GetEncryptedFiles)
+	api.GET("/decrypt-file", consumer, s.DecryptFile)
+	api.POST("/generate-link", consumer, s.GenerateSecureURL)
+	api.GET("/links", consumer, s.GetSecureLinks)
+	api.DELETE("/links/:id", consumer, s.RevokeSecureLink)
+	api.GET("/key-manager", RequireRole(ROLE_ADMIN, ROLE_OPERATOR), s.GetKeyManager)
+	api.POST("/key-manager/rotate", operator, s.RotateMasterKey)
+	api.POST("/key-rotations", admin, s.StartKeyRotation)
+	api.GET("/key-rotations", admin, s.GetKeyRotations)
+	api.GET("/key-rotations/:id", admin, s.GetKeyRotation)
+	api.POST("/key-rotations/:id/resume", admin, s.ResumeKeyRotation)
+
+	// The link token is the credential
+	router.GET(SECURE_FILE_PATH, s.SecureFileAccess)
+	// Public keys for verifying license tokens offline
+	router.GET(LICENSE_KEYS_PATH, s.GetLicenseKeys)
+	// swagger
+	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+
+	return router
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+
+	"license-encryption-service/licensetoken"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+const LICENSE_SIGNING_INFO = "sles-license-signing-v1"
+const LICENSE_KEYS_PATH = "/sles/api/v1/license-keys"
+
+// deriveLicenseSigningKey derives the Ed25519 key license tokens are signed
+// with from the master secret, so it's stable across restarts.
+func deriveLicenseSigningKey(secret []byte) (ed25519.PrivateKey, error) {
+
+	if len(secret) == 0 {
+		return nil, errors.New("Master secret is not configured")
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(LICENSE_SIGNING_INFO)), seed); err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// licenseKeySet returns the public keys license tokens are verified with.
+func (s *Server) licenseKeySet() licensetoken.KeySet {
+	return licensetoken.NewKeySet(s.LicenseSigningKey.Public().(ed25519.PublicKey))
+}
+
+// LicenseClaims returns the terms of the license as token claims.
+func (s *Server) LicenseClaims(license License) licensetoken.Claims {
+
+	claims := licensetoken.Claims{
+		ID:       license.Key.String(),
+		Issuer:   s.Config.BaseURL,
+		Tenant:   license.Tenant,
+		Type:     license.Type,
+		IssuedAt: s.Clock.Now().Unix(),
+		Limits: licensetoken.Limits{
+			Tokens:        license.TokensLeft,
+			EncryptTokens: license.EncryptTokensLeft,
+			DecryptTokens: license.DecryptTokensLeft,
+			Bytes:         license.BytesLeft,
+		},
+		Features: license.Features,
+	}
+	if license.NotBefore != nil {
+		claims.NotBefore = license.NotBefore.Unix()
+	}
+	if !license.ExpiryDate.IsZero() {
+		claims.Expiry = license.ExpiryDate.Unix()
+	}
+	if license.Scopes != nil {
+		scopes := licensetoken.Scopes(*license.Scopes)
+		claims.Scopes = &scopes
+	}
+	return claims
+}
+
+// SignLicense issues a token carrying the current terms of the license.
+func (s *Server) SignLicense(license License) (string, error) {
+
+	return licensetoken.Sign(s.LicenseClaims(license), s.LicenseSigningKey)
+}
+
+// parseLicenseToken returns the license key of a token signed by this server.
+// The terms in the token are for offline checks, the server goes by the
+// stored license, which may have been extended or revoked since.
+func (s *Server) parseLicenseToken(token string) (uuid.UUID, error) {
+
+	claims, err := licensetoken.Parse(token, s.licenseKeySet())
+	if err != nil {
+		return uuid.UUID{}, ErrInvalidLicenseKey.WithDetails(err.Error())
+	}
+	key, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return key, ErrInvalidLicenseKey.WithDetails(err.Error())
+	}
+	return key, nil
+}
+
+// @Summary License token keys
+// @Description The public keys license tokens are signed with, as a JSON Web Key Set. Client applications use them to verify license tokens offline.
+// @Produce json
+// @Success 200
+// @Router /sles/api/v1/license-keys [get]
+func (s *Server) GetLicenseKeys(c *gin.Context) {
+
+	c.IndentedJSON(http.StatusOK, s.licenseKeySet().JWKS())
+
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrLicenseNotFound = NewAPIError(http.StatusForbidden, "license_not_found", "License key doesn't exist")
+var ErrFileNotFound = NewAPIError(http.StatusNotFound, "file_not_found", "File doesn't exist")
+
+// FileRecord ties an encrypted file in the blob storage to the license it was
+// encrypted with. The id is generated by the server, the name the client
+// uploaded is only kept as metadata.
+type FileRecord struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	// Path of the encrypted data relative to the blob storage root, see ResolveFile
+	Path         string    `json:"path"`
+	LicenseKey   uuid.UUID `json:"licenseKey"`
+	OriginalName string    `json:"originalName,omitempty"`
+	ContentType  string    `json:"contentType,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	// Master key version the data key is wrapped under, 0 for files stored
+	// before versions were recorded
+	KeyVersion uint32 `json:"keyVersion,omitempty"`
+	// Key manager the data key is wrapped by
+	KeyManager string `json:"keyManager,omitempty"`
+}
+
+// DownloadName returns the file name the decrypted file is served as.
+func (r FileRecord) DownloadName() string {
+	if r.OriginalName != "" {
+		return r.OriginalName
+	}
+	return r.ID
+}
+
+func fileKey(tenant string, id string) string {
+	return tenant + "/" + id
+}
+
+// LicenseStore persists licenses.
+type LicenseStore interface {
+	GetLicense(key uuid.UUID) (License, error)
+	PutLicense(license License) error
+	// ListLicenses returns the licenses of the tenant.
+	ListLicenses(tenant string) ([]License, error)
+	// ConsumeLicense checks the license with CheckLicense and spends the
+	// tokens of the operation atomically, so concurrent callers can never use
+	// a license more often than it allows.
+	ConsumeLicense(key uuid.UUID, operation string, now time.Time) (License, error)
+	// UpdateLicense loads the license, applies change and stores the result
+	// atomically. Nothing is stored if change fails.
+	UpdateLicense(key uuid.UUID, change func(license *License) error) (License, error)
+	DeleteLicense(key uuid.UUID) error
+}
+
+// FileRegistry persists the encrypted files and the license they belong to.
+type FileRegistry interface {
+	GetFile(tenant string, id string) (FileRecord, error)
+	PutFile(record FileRecord) error
+	// UpdateFile loads the registration, applies change and stores the result
+	// atomically. Nothing is stored if change fails.
+	UpdateFile(tenant string, id string, change func(record *FileRecord) error) (FileRecord, error)
+	ListFiles(tenant string) ([]FileRecord, error)
+	// DeleteFile removes the registration, not the encrypted data.
+	DeleteFile(tenant string, id string) error
+}
+
+// LinkRegistry persists secure links.
+type LinkRegistry interface {
+	GetLink(id string) (LinkRecord, error)
+	PutLink(link LinkRecord) error
+	// ListLinks returns every link created for the license.
+	ListLinks(licenseKey uuid.UUID) ([]LinkRecord, error)
+	// UseLink checks the link with CheckLink and counts a download in the
+	// same atomic step.
+	UseLink(id string, now time.Time) (LinkRecord, error)
+	RevokeLink(id string, now time.Time) (LinkRecord, error)
+}
+
+// RateCounters keeps the rate limit counters of licenses.
+type RateCounters interface {
+	// AcquireRate checks the operation against the limits with AcquireRate
+	// and counts it in the same atomic step.
+	AcquireRate(key uuid.UUID, limits []RateLimit, operation string, bytes int64, now time.Time) (*RateStatus, error)
+}
+
+// UsageLog records the bytes consumed by each operation.
+type UsageLog interface {
+	RecordUsage(record UsageRecord) error
+	// ListUsage returns the usage of the license, oldest first.
+	ListUsage(licenseKey uuid.UUID) ([]UsageRecord, error)
+}
+
+// RotationJobs persists key rotation jobs and their progress.
+type RotationJobs interface {
+	GetRotation(id string) (RotationJob, error)
+	PutRotation(job RotationJob) error
+	// ListRotations returns the jobs of all tenants, oldest first.
+	ListRotations() ([]RotationJob, error)
+}
+
+// Store is implemented by the storage backends, which keep licenses, files,
+// links, rate counters, usage and rotation jobs side by side.
+type Store interface {
+	LicenseStore
+	FileRegistry
+	LinkRegistry
+	RateCounters
+	UsageLog
+	RotationJobs
+	Close() error
+}
+
+// MemoryStore keeps everything in memory, nothing survives a restart. Used in
+// tests.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	licenses map[uuid.UUID]License
+	files    map[string]FileRecord
+	links    map[string]LinkRecord
+	rates    map[uuid.UUID]map[string]RateCounter
+	usage    map[uuid.UUID][]UsageRecord
+	jobs     map[string]RotationJob
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		licenses: make(map[uuid.UUID]License),
+		files:    make(map[string]FileRecord),
+		links:    make(map[string]LinkRecord),
+		rates:    make(map[uuid.UUID]map[string]RateCounter),
+		usage:    make(map[uuid.UUID][]UsageRecord),
+		jobs:     make(map[string]RotationJob),
+	}
+}
+
+func (s *MemoryStore) GetLicense(key uuid.UUID) (License, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	license, exists := s.licenses[key]
+	if !exists {
+		return license, ErrLicenseNotFound
+	}
+	return license, nil
+}
+
+func (s *MemoryStore) PutLicense(license License) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.licenses[license.Key] = license
+	return nil
+}
+
+func (s *MemoryStore) ConsumeLicense(key uuid.UUID, operation string, now time.Time) (License, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	license, exists := s.licenses[key]
+	if !exists {
+		return license, ErrLicenseNotFound
+	}
+	if err := CheckLicense(license, operation, now); err != nil {
+		return license, err
+	}
+
+	SpendLicense(&license, operation)
+	s.licenses[key] = license
+	return license, nil
+}
+
+func (s *MemoryStore) UpdateLicense(key uuid.UUID, change func(license *License) error) (License, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	license, exists := s.licenses[key]
+	if !exists {
+		return license, ErrLicenseNotFound
+	}
+	if err := change(&license); err != nil {
+		return license, err
+	}
+	s.licenses[key] = license
+	return license, nil
+}
+
+func (s *MemoryStore) DeleteLicense(key uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.licenses[key]; !exists {
+		return ErrLicenseNotFound
+	}
+	delete(s.licenses, key)
+	delete(s.rates, key)
+	return nil
+}
+
+func (s *MemoryStore) ListLicenses(tenant string) ([]License, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	licenses := []License{}
+	for _, license := range s.licenses {
+		if license.Tenant == tenant {
+			licenses = append(licenses, license)
+		}
+	}
+	sort.Slice(licenses, func(i, j int) bool { return licenses[i].Key.String() < licenses[j].Key.String() })
+	return licenses, nil
+}
+
+func (s *MemoryStore) GetFile(tenant string, id string) (FileRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, exists := s.files[fileKey(tenant, id)]
+	if !exists {
+		return record, ErrFileNotFound
+	}
+	return record, nil
+}
+
+func (s *MemoryStore) PutFile(record FileRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[fileKey(record.Tenant, record.ID)] = record
+	return nil
+}
+
+func (s *MemoryStore) UpdateFile(tenant string, id string, change func(record *FileRecord) error) (FileRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.files[fileKey(tenant, id)]
+	if !exists {
+		return record, ErrFileNotFound
+	}
+	if err := change(&record); err != nil {
+		return record, err
+	}
+	s.files[fileKey(tenant, id)] = record
+	return record, nil
+}
+
+func (s *MemoryStore) DeleteFile(tenant string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.files[fileKey(tenant, id)]; !exists {
+		return ErrFileNotFound
+	}
+	delete(s.files, fileKey(tenant, id))
+	return nil
+}
+
+func (s *MemoryStore) ListFiles(tenant string) ([]FileRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := []FileRecord{}
+	for _, record := range s.files {
+		if record.Tenant == tenant {
+			files = append(files, record)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files, nil
+}
+
+func (s *MemoryStore) GetLink(id string) (LinkRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	link, exists := s.links[id]
+	if !exists {
+		return link, ErrLinkNotFound
+	}
+	return link, nil
+}
+
+func (s *MemoryStore) PutLink(link LinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.links[link.ID] = link
+	return nil
+}
+
+func (s *MemoryStore) ListLinks(licenseKey uuid.UUID) ([]LinkRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	links := []LinkRecord{}
+	for _, link := range s.links {
+		if link.LicenseKey == licenseKey {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+	return links, nil
+}
+
+func (s *MemoryStore) UseLink(id string, now time.Time) (LinkRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[id]
+	if !exists {
+		return link, ErrLinkNotFound
+	}
+	if err := CheckLink(link, now); err != nil {
+		return link, err
+	}
+
+	link.Downloads += 1
+	s.links[id] = link
+	return link, nil
+}
+
+func (s *MemoryStore) RevokeLink(id string, now time.Time) (LinkRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[id]
+	if !exists {
+		return link, ErrLinkNotFound
+	}
+	if link.RevokedAt == nil {
+		link.RevokedAt = &now
+		s.links[id] = link
+	}
+	return link, nil
+}
+
+func (s *MemoryStore) AcquireRate(key uuid.UUID, limits []RateLimit, operation string, bytes int64, now time.Time) (*RateStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counters, exists := s.rates[key]
+	if !exists {
+		counters = map[string]RateCounter{}
+		s.rates[key] = counters
+	}
+	return AcquireRate(counters, limits, operation, bytes, now)
+}
+
+func (s *MemoryStore) RecordUsage(record UsageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.usage[record.LicenseKey] = append(s.usage[record.LicenseKey], record)
+	return nil
+}
+
+func (s *MemoryStore) ListUsage(licenseKey uuid.UUID) ([]UsageRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]UsageRecord{}, s.usage[licenseKey]...), nil
+}
+
+func (s *MemoryStore) GetRotation(id string) (RotationJob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, exists := s.jobs[id]
+	if !exists {
+		return job, ErrRotationNotFound
+	}
+	return job, nil
+}
+
+func (s *MemoryStore) PutRotation(job RotationJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *MemoryStore) ListRotations() ([]RotationJob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := []RotationJob{}
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEFAULT_TENANT owns everything created before tenants existed, and requests
+// of credentials that don't name a tenant.
+const DEFAULT_TENANT = "default"
+
+// Tenant names end up in storage paths, so they are kept to a safe alphabet.
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func validTenant(tenant string) bool {
+	return tenantNamePattern.MatchString(tenant)
+}
+
+// tenantPath returns where a tenant's file is stored, relative to the root of
+// the blob storage.
+func tenantPath(tenant string, name string) string {
+	return filepath.Join("tenants", tenant, name)
+}
+
+// callerTenant returns the tenant of the authenticated principal. Routes
+// without authentication act for the default tenant.
+func callerTenant(c *gin.Context) string {
+	if principal, found := Principal(c); found && principal.Tenant != "" {
+		return principal.Tenant
+	}
+	return DEFAULT_TENANT
+}
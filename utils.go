@@ -1,34 +1,95 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
-	"errors"
-	"io"
+	"mime"
 	"mime/multipart"
-	"os"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"license-encryption-service/licensetoken"
+
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 const TIME_BOUND = "time-bound"
 const USAGE_LIMITED = "usage-limited"
-const OUTPUTDIR = "./encrypted_files"
+const HYBRID = "hybrid"
+const PERPETUAL = "perpetual"
+
+// Operations spending license tokens
+const OP_ENCRYPT = "encrypt"
+const OP_DECRYPT = "decrypt"
+
+const LICENSE_ACTIVE = "active"
+const LICENSE_SUSPENDED = "suspended"
+const LICENSE_REVOKED = "revoked"
 
+// FILE_ID_HEADER carries the id of a newly encrypted file.
+const FILE_ID_HEADER = "X-File-ID"
+
+// License combines optional constraints, all of which have to hold: a start
+// date, an expiry date (zero for none), token budgets and a byte budget (nil
+// for unlimited). TokensLeft is spent by every operation, the encrypt and
+// decrypt budgets only by their operation. BytesLeft is metered while files
+// are streamed, see licenseMeter. Type names the plan the license was sold as.
 type License struct {
-	Key        uuid.UUID `json:"key"`
-	Type       string    `json:"type"`
-	ExpiryDate time.Time `json:""expiryDate"`
-	TokensLeft int       `json:""tokensLeft"`
+	Key               uuid.UUID      `json:"key"`
+	Type              string         `json:"type"`
+	NotBefore         *time.Time     `json:"notBefore,omitempty"`
+	ExpiryDate        time.Time      `json:"expiryDate"`
+	TokensLeft        *int           `json:"tokensLeft,omitempty"`
+	EncryptTokensLeft *int           `json:"encryptTokensLeft,omitempty"`
+	DecryptTokensLeft *int           `json:"decryptTokensLeft,omitempty"`
+	BytesLeft         *int64         `json:"bytesLeft,omitempty"`
+	RateLimits        []RateLimit    `json:"rateLimits,omitempty"`
+	Features          []string       `json:"features,omitempty"`
+	Scopes            *LicenseScopes `json:"scopes,omitempty"`
+	Tenant            string         `json:"tenant"`
+	Status            string         `json:"status"`
+	// Signed license token, for licenses issued as tokens
+	Token string `json:"token,omitempty"`
 }
 
+// LicenseRequest describes a new license. 'time-bound' and 'usage-limited'
+// licenses take days or tokens as 'expiry'. 'hybrid' licenses combine any of
+// 'days', 'tokens', 'encryptTokens', 'decryptTokens' and 'bytes', and 'perpetual'
+// licenses take no limits. 'notBefore' delays the start of any license and
+// 'rateLimits' cap its use within rolling windows. 'features' are flags for
+// client applications, 'scopes' restrict what the license can be used for. With 'signed' the license is also issued as a token
+// clients can verify offline.
 type LicenseRequest struct {
-	Type   string `json:"type" binding:"required"`
-	Expiry int    `json:"expiry" binding:"required"`
+	Type          string         `json:"type" binding:"required"`
+	Expiry        int            `json:"expiry"`
+	NotBefore     *time.Time     `json:"notBefore"`
+	Days          int            `json:"days"`
+	Tokens        int            `json:"tokens"`
+	EncryptTokens int            `json:"encryptTokens"`
+	DecryptTokens int            `json:"decryptTokens"`
+	Bytes         int64          `json:"bytes"`
+	RateLimits    []RateLimit    `json:"rateLimits"`
+	Features      []string       `json:"features"`
+	Scopes        *LicenseScopes `json:"scopes"`
+	Signed        bool           `json:"signed"`
+}
+
+// LicenseUpdate extends the expiry of a license by days or adds tokens to its
+// budgets. Only constraints the license has can be extended.
+type LicenseUpdate struct {
+	ExtendDays       int   `json:"extendDays"`
+	AddTokens        int   `json:"addTokens"`
+	AddEncryptTokens int   `json:"addEncryptTokens"`
+	AddDecryptTokens int   `json:"addDecryptTokens"`
+	AddBytes         int64 `json:"addBytes"`
+}
+
+// budget returns a token or byte budget of n.
+func budget[T int | int64](n T) *T {
+	return &n
 }
 
 type FormRequest struct {
@@ -37,8 +98,22 @@ type FormRequest struct {
 }
 
 type URLRequest struct {
-	FilePath   string `json:"filepath" binding:"required"`
-	LicenseKey string `json:"licensekey" binding:"required"`
+	FileID       string `json:"fileid" binding:"required"`
+	LicenseKey   string `json:"licensekey" binding:"required"`
+	MaxDownloads int    `json:"maxDownloads"`
+}
+
+// DetectContentType returns the content type of an uploaded file, preferring
+// the type declared by the client over the one implied by the extension.
+func DetectContentType(fileName string, declared string) string {
+
+	if declared != "" && declared != "application/octet-stream" {
+		return declared
+	}
+	if byExtension := mime.TypeByExtension(filepath.Ext(fileName)); byExtension != "" {
+		return byExtension
+	}
+	return "application/octet-stream"
 }
 
 func GetLogger() *logrus.Logger {
@@ -49,143 +124,148 @@ func GetLogger() *logrus.Logger {
 	return Log
 }
 
-func ValidateLicenseKey(key uuid.UUID) (License, error) {
+var ErrLicenseExpired = NewAPIError(http.StatusForbidden, "license_expired", "License key expired")
+var ErrLicenseNotYetValid = NewAPIError(http.StatusForbidden, "license_not_yet_valid", "License key is not valid yet")
+var ErrLicenseSuspended = NewAPIError(http.StatusForbidden, "license_suspended", "License key is suspended")
+var ErrLicenseRevoked = NewAPIError(http.StatusForbidden, "license_revoked", "License key has been revoked")
+var ErrLicenseStatus = NewAPIError(http.StatusConflict, "license_status_conflict", "The license can't be changed in its current status")
+var ErrInvalidLicenseUpdate = NewAPIError(http.StatusBadRequest, "invalid_license_update", "Provide positive extensions for limits the license has")
 
-	var licenseData License
+// ValidateLicenseKey checks the license, given as bare key or license token,
+// can be used by the tenant for the operation. Licenses of other tenants are
+// reported as missing.
+func (s *Server) ValidateLicenseKey(tenant string, licenseKey string, operation string) (License, error) {
 
-	licenseData, exists := Licenses[key]
-	if !exists {
-
-		return licenseData, errors.New("License key doesn't exist")
+	key, err := s.ParseLicenseKey(licenseKey)
+	if err != nil {
+		return License{}, err
 	}
 
-	if licenseData.Type == TIME_BOUND && (licenseData.ExpiryDate.Sub(time.Now()) < 0) {
+	licenseData, err := s.Licenses.GetLicense(key)
+	if err != nil {
 
-		return licenseData, errors.New("License key expired")
+		return licenseData, err
 	}
 
-	if licenseData.Type == USAGE_LIMITED && (licenseData.TokensLeft <= 0) {
-
-		return licenseData, errors.New("License key expired")
+	if licenseData.Tenant != tenant {
+		return License{}, ErrLicenseNotFound
 	}
 
-	return licenseData, nil
+	return licenseData, CheckLicense(licenseData, operation, s.Clock.Now())
 
 }
 
-func AESDecryption(key uuid.UUID, srcFile *os.File, destFile *os.File) error {
+// CheckLicense reports whether the license can be used for the operation at
+// the given time. The stores call it while holding the license, so it must
+// stay side effect free.
+func CheckLicense(licenseData License, operation string, now time.Time) error {
 
-	// Generate a random initialization vector(iv)
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return err
+	switch licenseData.Status {
+	case LICENSE_REVOKED:
+		return ErrLicenseRevoked
+	case LICENSE_SUSPENDED:
+		return ErrLicenseSuspended
 	}
 
-	// Read iv from encrypted file.
-	if _, err := srcFile.Read(iv); err != nil {
-		return err
+	if licenseData.NotBefore != nil && now.Before(*licenseData.NotBefore) {
+
+		return ErrLicenseNotYetValid.WithDetails(gin.H{"notBefore": licenseData.NotBefore})
 	}
 
-	// Hash UUID using SHA-256 to get a 32-byte AES key
-	hash := sha256.New()
-	hash.Write(key[:]) // Write the 16-byte UUID
-	decKey := hash.Sum(nil)
+	if !licenseData.ExpiryDate.IsZero() && expired(licenseData.ExpiryDate, now) {
 
-	// Generate a new cipher with key(UUID)
-	cipherBlock, err := aes.NewCipher(decKey[:])
-	if err != nil {
-		return err
+		return ErrLicenseExpired
 	}
 
-	// Create CBC Decrypter using the cipherBlock(created with uuid as key)
-	blockMode := cipher.NewCBCDecrypter(cipherBlock, iv)
+	if licenseData.TokensLeft != nil && *licenseData.TokensLeft <= 0 {
 
-	// Buffer for reading the input file in blocks
-	blockSize := cipherBlock.BlockSize()
-	buffer := make([]byte, blockSize)
+		return ErrLicenseExpired.WithDetails(gin.H{"budget": "tokens"})
+	}
 
-	for {
-		num_bytes_read, err := srcFile.Read(buffer)
-		if err == io.EOF {
-			// Reached end of the file. decryption completed
-			break
-		}
-		if err != nil {
-			return err
-		}
+	if operation == OP_ENCRYPT && licenseData.EncryptTokensLeft != nil && *licenseData.EncryptTokensLeft <= 0 {
 
-		// If the last block size is less than blocksize, we need to do padding.
-		// As encrypter needs complete blocksize for enecryption
-		if num_bytes_read < blockSize {
-			buffer = append(buffer[:num_bytes_read], make([]byte, blockSize-num_bytes_read)...)
-		}
+		return ErrLicenseExpired.WithDetails(gin.H{"budget": "encryptTokens"})
+	}
 
-		//Encrypt the current chunk of data
-		blockMode.CryptBlocks(buffer, buffer)
+	if operation == OP_DECRYPT && licenseData.DecryptTokensLeft != nil && *licenseData.DecryptTokensLeft <= 0 {
 
-		// write encrypted data to file
-		if _, err := destFile.Write(buffer); err != nil {
-			return err
-		}
+		return ErrLicenseExpired.WithDetails(gin.H{"budget": "decryptTokens"})
 	}
-	return nil
 
+	return nil
 }
 
-func AESEncryption(key uuid.UUID, srcFile multipart.File, destFile *os.File) error {
+// SpendLicense takes one token from every budget the operation draws from. The
+// budgets are replaced rather than decremented in place, copies of the license
+// handed out earlier share them.
+func SpendLicense(licenseData *License, operation string) {
 
-	// Generate a random initialization vector(iv)
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return err
+	if licenseData.TokensLeft != nil {
+		licenseData.TokensLeft = budget(*licenseData.TokensLeft - 1)
+	}
+	if operation == OP_ENCRYPT && licenseData.EncryptTokensLeft != nil {
+		licenseData.EncryptTokensLeft = budget(*licenseData.EncryptTokensLeft - 1)
+	}
+	if operation == OP_DECRYPT && licenseData.DecryptTokensLeft != nil {
+		licenseData.DecryptTokensLeft = budget(*licenseData.DecryptTokensLeft - 1)
 	}
+}
+
+// ConsumeLicense validates the license and spends a token of its budgets for
+// the operation in the same atomic step.
+func (s *Server) ConsumeLicense(key uuid.UUID, operation string) (License, error) {
+	return s.Licenses.ConsumeLicense(key, operation, s.Clock.Now())
+}
 
-	// Write iv to output file. used while decrypting
-	if _, err := destFile.Write(iv); err != nil {
-		return err
+// RefundLicense gives back the tokens SpendLicense took for the operation.
+func RefundLicense(licenseData *License, operation string) {
+
+	if licenseData.TokensLeft != nil {
+		licenseData.TokensLeft = budget(*licenseData.TokensLeft + 1)
+	}
+	if operation == OP_ENCRYPT && licenseData.EncryptTokensLeft != nil {
+		licenseData.EncryptTokensLeft = budget(*licenseData.EncryptTokensLeft + 1)
 	}
+	if operation == OP_DECRYPT && licenseData.DecryptTokensLeft != nil {
+		licenseData.DecryptTokensLeft = budget(*licenseData.DecryptTokensLeft + 1)
+	}
+}
 
-	// Hash UUID using SHA-256 to get a 32-byte AES key
-	hash := sha256.New()
-	hash.Write(key[:]) // Write the 16-byte UUID
-	encKey := hash.Sum(nil)
+// refundLicense returns the token of an operation refused after the license
+// was consumed.
+func (s *Server) refundLicense(key uuid.UUID, operation string) {
 
-	// Generate a new cipher with key(UUID)
-	cipherBlock, err := aes.NewCipher(encKey)
+	_, err := s.Licenses.UpdateLicense(key, func(license *License) error {
+		RefundLicense(license, operation)
+		return nil
+	})
 	if err != nil {
-		return err
+		s.Log.WithError(err).Warn("Unable to refund token to license ", key)
 	}
+}
 
-	// Create CBC Encrypter using the cipherBlock(created with uuid as key)
-	blockMode := cipher.NewCBCEncrypter(cipherBlock, iv)
-
-	// Buffer for reading the input file in blocks
-	blockSize := cipherBlock.BlockSize()
-	buffer := make([]byte, blockSize)
+// ParseLicenseKey parses a license key given by the client, either the bare
+// key or a license token signed by this server.
+func (s *Server) ParseLicenseKey(licenseKey string) (uuid.UUID, error) {
 
-	for {
-		num_bytes_read, err := srcFile.Read(buffer)
-		if err == io.EOF {
-			// Reached end of the file. encryption completed
-			break
-		}
-		if err != nil {
-			return err
-		}
+	if licensetoken.LooksLikeToken(licenseKey) {
+		return s.parseLicenseToken(licenseKey)
+	}
 
-		// If the last block size is less than blocksize, we need to do padding.
-		// As encrypter needs complete blocksize for enecryption
-		if num_bytes_read < blockSize {
-			buffer = append(buffer[:num_bytes_read], make([]byte, blockSize-num_bytes_read)...)
-		}
+	key, err := uuid.Parse(licenseKey)
+	if err != nil {
+		return key, ErrInvalidLicenseKey.WithDetails(err.Error())
+	}
+	return key, nil
+}
 
-		//Encrypt the current chunk of data
-		blockMode.CryptBlocks(buffer, buffer)
+// SanitizeFileName reduces a client supplied file name to its last element,
+// for either path separator. It's only ever used as metadata.
+func SanitizeFileName(fileName string) string {
 
-		// write encrypted data to file
-		if _, err := destFile.Write(buffer); err != nil {
-			return err
-		}
+	name := path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
 	}
-	return nil
+	return name
 }
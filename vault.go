@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const VAULT_TIMEOUT = 10 * time.Second
+
+// VaultTransit is a KeyManager backed by the transit secrets engine of
+// HashiCorp Vault, or a KMS speaking the same API (OpenBao, HSM gateways).
+// The master key never leaves the KMS: data keys are sent to it to be wrapped
+// and unwrapped. The transit key has to be created with derived=true, the
+// license is passed as the derivation context.
+type VaultTransit struct {
+	Addr   string
+	Mount  string
+	Key    string
+	Token  string
+	Client *http.Client
+}
+
+func NewVaultTransit(addr string, mount string, key string, token string) *VaultTransit {
+	return &VaultTransit{
+		Addr:   strings.TrimSuffix(addr, "/"),
+		Mount:  mount,
+		Key:    key,
+		Token:  token,
+		Client: &http.Client{Timeout: VAULT_TIMEOUT},
+	}
+}
+
+// vaultResponse is the envelope of Vault API responses.
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []string        `json:"errors"`
+}
+
+// call sends a request to the transit engine and decodes the data of the
+// response into data. Failures are reported as ErrKeyManagerUnavailable, a
+// missing token or key isn't the client's fault; requests Vault refused wrap
+// a *vaultError.
+func (v *VaultTransit) call(method string, path string, body any, data any) error {
+
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	// Mounts can be nested, like transit/prod, only their segments are escaped
+	segments := strings.Split(strings.Trim(v.Mount, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	endpoint := v.Addr + "/v1/" + strings.Join(segments, "/") + "/" + path
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return ErrKeyManagerUnavailable.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	// Some endpoints answer 204 without a body
+	var envelope vaultResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&envelope)
+	if errors.Is(decodeErr, io.EOF) {
+		decodeErr = nil
+	}
+	if resp.StatusCode >= 300 {
+		return ErrKeyManagerUnavailable.Wrap(&vaultError{Status: resp.StatusCode, Messages: envelope.Errors})
+	}
+	if decodeErr != nil {
+		return ErrKeyManagerUnavailable.Wrap(decodeErr)
+	}
+	if data == nil || envelope.Data == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Data, data)
+}
+
+// vaultError is a request Vault answered with an error status.
+type vaultError struct {
+	Status   int
+	Messages []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("Vault returned %d: %s", e.Status, strings.Join(e.Messages, "; "))
+}
+
+func (v *VaultTransit) Wrap(license uuid.UUID, dataKey []byte, aad []byte) (WrappedKey, error) {
+
+	var data struct {
+		Ciphertext string `json:"ciphertext"`
+		KeyVersion uint32 `json:"key_version"`
+	}
+	err := v.call(http.MethodPost, "encrypt/"+url.PathEscape(v.Key), map[string]string{
+		"plaintext":       base64.StdEncoding.EncodeToString(dataKey),
+		"context":         base64.StdEncoding.EncodeToString(license[:]),
+		"associated_data": base64.StdEncoding.EncodeToString(aad),
+	}, &data)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+
+	// Older servers only report the version inside the ciphertext
+	version := data.KeyVersion
+	if version == 0 {
+		version, err = vaultCiphertextVersion(data.Ciphertext)
+		if err != nil {
+			return WrappedKey{}, err
+		}
+	}
+	return WrappedKey{Version: version, Ciphertext: []byte(data.Ciphertext)}, nil
+}
+
+func (v *VaultTransit) Unwrap(license uuid.UUID, wrapped WrappedKey, aad []byte) ([]byte, error) {
+
+	// The version is part of the ciphertext, it has to agree with the header
+	version, err := vaultCiphertextVersion(string(wrapped.Ciphertext))
+	if err != nil || version != wrapped.Version {
+		return nil, ErrKeyUnwrap
+	}
+
+	var data struct {
+		Plaintext string `json:"plaintext"`
+	}
+	err = v.call(http.MethodPost, "decrypt/"+url.PathEscape(v.Key), map[string]string{
+		"ciphertext":      string(wrapped.Ciphertext),
+		"context":         base64.StdEncoding.EncodeToString(license[:]),
+		"associated_data": base64.StdEncoding.EncodeToString(aad),
+	}, &data)
+	var vaultErr *vaultError
+	if errors.As(err, &vaultErr) && vaultErr.Status == http.StatusBadRequest {
+		// Vault refuses ciphertexts it can't authenticate with 400, and
+		// versions below the key's min_decryption_version as well
+		return nil, ErrKeyUnwrap.Wrap(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(data.Plaintext)
+	if err != nil {
+		return nil, ErrKeyUnwrap.Wrap(err)
+	}
+	return dataKey, nil
+}
+
+func (v *VaultTransit) Rotate() (uint32, error) {
+
+	if err := v.call(http.MethodPost, "keys/"+url.PathEscape(v.Key)+"/rotate", nil, nil); err != nil {
+		return 0, err
+	}
+	return currentKeyVersion(v)
+}
+
+func (v *VaultTransit) Describe() (KeyInfo, error) {
+
+	var data struct {
+		LatestVersion uint32         `json:"latest_version"`
+		Keys          map[string]any `json:"keys"`
+		Derived       bool           `json:"derived"`
+	}
+	if err := v.call(http.MethodGet, "keys/"+url.PathEscape(v.Key), nil, &data); err != nil {
+		return KeyInfo{}, err
+	}
+	if !data.Derived {
+		return KeyInfo{}, fmt.Errorf("Transit key %s must be created with derived=true", v.Key)
+	}
+
+	info := KeyInfo{Backend: KEY_MANAGER_VAULT_TRANSIT, Key: v.Mount + "/" + v.Key, CurrentVersion: data.LatestVersion}
+	for name := range data.Keys {
+		if version, err := strconv.ParseUint(name, 10, 32); err == nil {
+			info.Versions = append(info.Versions, uint32(version))
+		}
+	}
+	slices.Sort(info.Versions)
+	return info, nil
+}
+
+// vaultCiphertextVersion returns the key version of a "vault:v<N>:..."
+// ciphertext.
+func vaultCiphertextVersion(ciphertext string) (uint32, error) {
+
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return 0, errors.New("Unexpected transit ciphertext")
+	}
+	version, err := strconv.ParseUint(parts[1][1:], 10, 32)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("Unexpected transit ciphertext version %q", parts[1])
+	}
+	return uint32(version), nil
+}